@@ -1,7 +1,6 @@
 package ichiran
 
 import (
-	"os"
 	"strings"
 	"testing"
 
@@ -9,50 +8,26 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-const (
-	// ICHIRAN_ADVANCED_TEST should be set to "1" to run advanced tests
-	// These tests use longer and more complex Japanese text
-	advancedTestEnvVar = "ICHIRAN_ADVANCED_TEST"
-)
-
-// skipIfNotAdvancedTest skips the test if ICHIRAN_ADVANCED_TEST is not set to "1"
-func skipIfNotAdvancedTest(t *testing.T) {
-	if os.Getenv(advancedTestEnvVar) != "1" {
-		t.Skip("skipping advanced test; set ICHIRAN_ADVANCED_TEST=1 to run")
-	}
-
-	// Also skip if manual tests are not enabled (we need Docker)
-	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
-		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
-	}
-}
-
 // TestComplexSentenceWithNestedClauses tests a complex sentence with nested clauses
 func TestComplexSentenceWithNestedClauses(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Complex sentence with nested clauses, quotes, and multiple types of punctuation
 	// "Yesterday, I suddenly dropped by a bookstore, found a difficult philosophy book, and my heart trembled."
 	japaneseText := "昨日、ふと立ち寄った本屋で、難解な哲学書を見つけ、心が震えました。"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Verify we have a reasonable number of tokens
 	tokens := *tokensPtr
 	assert.GreaterOrEqual(t, len(tokens), 15, "Should have at least 15 tokens for complex sentence")
 
-	// Count punctuation marks
+	// Count punctuation marks, ichiran turns them to ASCII followed by a
+	// space, which is a token of its own
 	var commaCount, periodCount int
 	for _, token := range tokens {
-		if token.Surface == "、" || token.Surface == ", " {
+		if token.Surface == "、" || token.Surface == "," {
 			commaCount++
-		} else if token.Surface == "。" || token.Surface == ". " {
+		} else if token.Surface == "。" || token.Surface == "." {
 			periodCount++
 		}
 	}
@@ -112,19 +87,12 @@ func TestComplexSentenceWithNestedClauses(t *testing.T) {
 
 // TestMixedLanguageText tests text that contains Japanese and non-Japanese elements
 func TestMixedLanguageText(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Mixed text with English, numbers, and Japanese
 	// "I bought a new iPhone 13 in Tokyo last week for ¥150,000."
 	japaneseText := "先週、東京で新しいiPhone 13を¥150,000で買いました。"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Verify we get tokens for both Japanese and non-Japanese parts
 	tokens := *tokensPtr
@@ -164,12 +132,6 @@ func TestMixedLanguageText(t *testing.T) {
 
 // TestLongArticleText tests analysis of a longer Japanese news article
 func TestLongArticleText(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Longer Japanese text (excerpt from a news article)
 	japaneseText := `日本の科学者たちは、地球温暖化の影響で海水温が上昇していることに警鐘を鳴らしています。
 最新の研究によると、過去50年間で日本周辺の海水温は約1.2度上昇しており、これによって日本の気候だけでなく、
@@ -192,8 +154,7 @@ func TestLongArticleText(t *testing.T) {
 			continue
 		}
 
-		tokensPtr, err := Analyze(para)
-		require.NoError(t, err)
+		tokensPtr := analyzeFixture(t, para)
 
 		// Append tokens from this paragraph
 		tokens := *tokensPtr
@@ -242,18 +203,11 @@ func TestLongArticleText(t *testing.T) {
 
 // TestSpecializedVocabulary tests analysis of text with technical/specialized vocabulary
 func TestSpecializedVocabulary(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Text with specialized medical and technical vocabulary
 	japaneseText := "人工知能による画像診断システムを用いて、早期段階での悪性腫瘍の検出率が向上しました。量子コンピューティングの研究進展によって、将来的には創薬プロセスも大幅に効率化されるでしょう。"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Check for technical terms
 	tokens := *tokensPtr
@@ -294,18 +248,11 @@ func TestSpecializedVocabulary(t *testing.T) {
 
 // TestClassicalJapaneseText tests analysis of classical/literary Japanese
 func TestClassicalJapaneseText(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Classical Japanese text (from the Tale of Genji, opening lines)
 	japaneseText := "いづれの御時にか、女御、更衣あまたさぶらひたまひける中に、いとやむごとなき際にはあらぬが、すぐれて時めきたまふありけり。"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Even with classical Japanese, we should get tokenization
 	tokens := *tokensPtr
@@ -328,12 +275,6 @@ func TestClassicalJapaneseText(t *testing.T) {
 
 // TestEdgeCases tests various edge cases and unusual inputs
 func TestEdgeCases(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Test cases with edge case inputs
 	testCases := []struct {
 		name     string
@@ -375,8 +316,7 @@ func TestEdgeCases(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Analyze the text
-			tokensPtr, err := Analyze(tc.input)
-			require.NoError(t, err, "Analysis should not fail")
+			tokensPtr := analyzeFixture(t, tc.input)
 
 			// Verify token count
 			tokens := *tokensPtr
@@ -395,18 +335,11 @@ func TestEdgeCases(t *testing.T) {
 
 // TestComplexGrammaticalStructures tests parsing of sentences with complex grammar
 func TestComplexGrammaticalStructures(t *testing.T) {
-	skipIfNotAdvancedTest(t)
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Text with complex grammatical structures, conditional clauses, passive voice, etc.
 	japaneseText := "もし私が誘われていなかったら、そのパーティーに行かなかったでしょうし、あなたにも会えなかったかもしれません。物事は時々、予想もしなかった形で展開するものですね。"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Verify we get tokens
 	tokens := *tokensPtr
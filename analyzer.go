@@ -0,0 +1,22 @@
+package ichiran
+
+import (
+	"context"
+)
+
+// Analyzer is what code analyzing Japanese text needs from this package.
+// IchiranManager implements it on top of Docker, FakeAnalyzer replays recorded
+// outputs of ichiran for tests that can't run the containers.
+type Analyzer interface {
+	// Analyze performs the morphological analysis of text
+	Analyze(ctx context.Context, text string) (*JSONTokens, error)
+	// Status returns the current status of the backend
+	Status(ctx context.Context) (string, error)
+	// Close releases the resources held by the backend
+	Close() error
+}
+
+var (
+	_ Analyzer = (*IchiranManager)(nil)
+	_ Analyzer = (*FakeAnalyzer)(nil)
+)
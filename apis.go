@@ -12,11 +12,12 @@ import (
 )
 
 // TokenizedStr returns a string of all tokens separated by spaces using intelligent spacing rules.
+// Whitespace found in the input is kept as is.
 func (tokens JSONTokens) Tokenized() string {
 	parts := tokens.TokenizedParts()
 	// Debug the token parts to see what we got
 	Logger.Debug().Msgf("Tokenized parts: %v", parts)
-	return JoinWithSpacingRule(parts)
+	return tokens.joinWithSpacingRule(parts)
 }
 
 // TokenizedParts returns a slice of all token surfaces.
@@ -26,8 +27,8 @@ func (tokens JSONTokens) TokenizedParts() (parts []string) {
 
 	for i, token := range tokens {
 		// Log detailed token information
-		Logger.Debug().Msgf("Token #%d: Surface: '%s', IsLexical: %v, Kana: '%s'",
-			i, token.Surface, token.IsLexical, token.Kana)
+		Logger.Debug().Msgf("Token #%d: Surface: '%s', Kind: %v, Kana: '%s'",
+			i, token.Surface, token.Kind, token.Kana)
 
 		// Always include the token's surface
 		parts = append(parts, token.Surface)
@@ -44,7 +45,7 @@ func (tokens JSONTokens) Kana() string {
 // KanaParts returns a slice of all tokens in kana form where available.
 func (tokens JSONTokens) KanaParts() (parts []string) {
 	for _, token := range tokens {
-		if token.IsLexical && token.Kana != "" {
+		if token.IsWord() && token.Kana != "" {
 			parts = append(parts, token.Kana)
 		} else {
 			parts = append(parts, token.Surface)
@@ -54,15 +55,16 @@ func (tokens JSONTokens) KanaParts() (parts []string) {
 }
 
 // Roman returns a string of all tokens in romanized form using intelligent spacing rules.
+// Whitespace found in the input is kept as is.
 func (tokens JSONTokens) Roman() string {
 	parts := tokens.RomanParts()
-	return JoinWithSpacingRule(parts)
+	return tokens.joinWithSpacingRule(parts)
 }
 
 // RomanParts returns a slice of all tokens in romanized form.
 func (tokens JSONTokens) RomanParts() (parts []string) {
 	for _, token := range tokens {
-		if token.IsLexical && token.Romaji != "" {
+		if token.IsWord() && token.Romaji != "" {
 			parts = append(parts, token.Romaji)
 		} else {
 			parts = append(parts, token.Surface)
@@ -81,19 +83,25 @@ func (tokens JSONTokens) ToMorphemes() JSONTokens {
 			for _, component := range token.Components {
 				// Create a copy of the component
 				morpheme := &JSONToken{
-					Surface:     component.Surface,
-					IsLexical:   true, // Components are always lexical content
-					Reading:     component.Reading,
-					Kana:        component.Kana,
-					Romaji:      component.Romaji,
-					Score:       component.Score,
-					Seq:         component.Seq,
-					Gloss:       component.Gloss,
-					Conj:        component.Conj,
-					Alternative: component.Alternative,
-					Compound:    component.Compound,
-					Components:  component.Components,
-					Raw:         component.Raw,
+					Surface:       component.Surface,
+					Kind:          TokenWord, // Components are always lexical content
+					IsLexical:     true,
+					Reading:       component.Reading,
+					Kana:          component.Kana,
+					Romaji:        component.Romaji,
+					Score:         component.Score,
+					Seq:           component.Seq,
+					Gloss:         component.Gloss,
+					Conj:          component.Conj,
+					Alternative:   component.Alternative,
+					Compound:      component.Compound,
+					Components:    component.Components,
+					Raw:           component.Raw,
+					KanjiReadings: component.KanjiReadings,
+					Start:         component.Start,
+					End:           component.End,
+					StartByte:     component.StartByte,
+					EndByte:       component.EndByte,
 				}
 				morphemes = append(morphemes, morpheme)
 			}
@@ -119,7 +127,10 @@ func (tokens JSONTokens) GlossParts() (parts []string) {
 	morphemes := tokens.ToMorphemes()
 
 	for _, token := range morphemes {
-		if !token.IsLexical {
+		if token.Kind == TokenWhitespace {
+			continue
+		}
+		if !token.IsWord() {
 			parts = append(parts, token.Surface)
 			continue
 		}
@@ -92,3 +92,30 @@ func TestGlossMethods(t *testing.T) {
 		assert.Contains(t, result, "日本語(Japanese language)")
 	})
 }
+
+func TestTokenizedKeepsWhitespace(t *testing.T) {
+	tokens := JSONTokens{
+		{Surface: "Hello", Kind: TokenLatin},
+		{Surface: " \n", Kind: TokenWhitespace},
+		{Surface: "世界", Kind: TokenWord, IsLexical: true, Kana: "せかい", Romaji: "sekai"},
+		{Surface: "　", Kind: TokenWhitespace},
+		{Surface: "!", Kind: TokenPunctuation},
+	}
+
+	assert.Equal(t, "Hello \n世界　!", tokens.Tokenized())
+	assert.Equal(t, "Hello \nsekai　!", tokens.Roman())
+	assert.Equal(t, "Hello \nせかい　!", tokens.Kana())
+}
+
+func TestUnsetKindFallsBackToIsLexical(t *testing.T) {
+	tokens := JSONTokens{
+		{Surface: "世界", IsLexical: true, Kana: "せかい", Romaji: "sekai"},
+		{Surface: "。", IsLexical: false, Kana: "。", Romaji: "."},
+	}
+
+	assert.Equal(t, TokenUnknown, tokens[0].Kind)
+	assert.True(t, tokens[0].IsWord())
+	assert.False(t, tokens[1].IsWord())
+	assert.Equal(t, []string{"sekai", "。"}, tokens.RomanParts())
+	assert.Equal(t, []string{"せかい", "。"}, tokens.KanaParts())
+}
@@ -0,0 +1,302 @@
+package ichiran
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ichiranDatabase is the database of ichiran in the pg container
+const ichiranDatabase = "jmdict"
+
+// pgDumpMagic starts every dump in the custom format of pg_dump
+const pgDumpMagic = "PGDMP"
+
+// pgReadyTimeout bounds the wait for Postgres to accept connections once the
+// pg container started, and pgPollInterval is the wait between two checks
+var (
+	pgReadyTimeout = 2 * time.Minute
+	pgPollInterval = time.Second
+)
+
+// DefaultMinTableRows is the minimum number of rows CheckIntegrity expects in
+// each table of the ichiran database. The figures are well below those of any
+// JMdict release so that they catch truncated or partial databases, not
+// dictionary updates.
+var DefaultMinTableRows = map[string]int64{
+	"entry":       100000,
+	"kanji_text":  100000,
+	"kana_text":   100000,
+	"sense":       100000,
+	"gloss":       100000,
+	"conjugation": 10000,
+}
+
+// IntegrityReport is the outcome of CheckIntegrity
+type IntegrityReport struct {
+	Rows     map[string]int64 // Number of rows of each table checked
+	Problems []string         // What is wrong with the database, empty if nothing
+}
+
+// BackupDatabase dumps the ichiran database to path with pg_dump, in its custom
+// format, while the containers keep serving queries. The dump can be brought
+// back with RestoreDatabase, which is much faster than rebuilding pgdata.
+func (im *IchiranManager) BackupDatabase(ctx context.Context, path string) error {
+	if !im.usesDocker() {
+		return fmt.Errorf("backups are only supported by the Docker backend")
+	}
+
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		output := bufio.NewWriter(w)
+		if err := im.execPg(ctx, []string{"pg_dump", "--format=custom", ichiranDatabase}, nil, output); err != nil {
+			return fmt.Errorf("failed to dump database: %w", err)
+		}
+		return output.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// RestoreDatabase replaces the ichiran database by the dump at path, made by
+// BackupDatabase. The containers are stopped and the pg container is started
+// alone meanwhile, so that ichiran doesn't hold connections to the database;
+// both are started again once the restore is over, whether it succeeded or
+// not, and the integrity of the restored database is checked.
+func (im *IchiranManager) RestoreDatabase(ctx context.Context, path string) error {
+	if !im.usesDocker() {
+		return fmt.Errorf("backups are only supported by the Docker backend")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer file.Close()
+	magic := make([]byte, len(pgDumpMagic))
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != pgDumpMagic {
+		return fmt.Errorf("%s is not a backup made by BackupDatabase", path)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	return im.withoutRecovery(ctx, func() error { return im.restoreDatabase(ctx, file) })
+}
+
+// restoreDatabase does the work of RestoreDatabase, restoring the dump read from r
+func (im *IchiranManager) restoreDatabase(ctx context.Context, r io.Reader) (err error) {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	im.closeSession()
+	im.resetBackendVersion()
+	if err := im.docker.Stop(); err != nil {
+		return fmt.Errorf("failed to stop containers: %w", err)
+	}
+	defer func() {
+		// Init skips projects that are still partly running: stop pg again so
+		// that both containers are started, then wait until ichiran is ready
+		if stopErr := im.docker.Stop(); stopErr != nil {
+			Logger.Debug().Err(stopErr).Msg("failed to stop pg container after restore")
+		}
+		if restartErr := im.docker.InitQuiet(); restartErr != nil && err == nil {
+			err = fmt.Errorf("failed to restart containers: %w", restartErr)
+		}
+		if err == nil {
+			_, err = im.CheckIntegrity(ctx)
+		}
+	}()
+
+	if err := client.ContainerStart(ctx, im.pgContainerName(), container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start pg container: %w", err)
+	}
+	if err := im.waitPg(ctx); err != nil {
+		return err
+	}
+
+	// --create with --clean drops the database then creates it from the dump
+	cmd := []string{"pg_restore", "--clean", "--if-exists", "--create", "--exit-on-error", "--dbname=postgres"}
+	if err := im.execPg(ctx, cmd, r, io.Discard); err != nil {
+		return fmt.Errorf("failed to restore database: %w", err)
+	}
+	return nil
+}
+
+// waitPg waits until Postgres accepts connections in the pg container, for up
+// to pgReadyTimeout
+func (im *IchiranManager) waitPg(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pgReadyTimeout)
+	defer cancel()
+	for {
+		err := im.execPg(ctx, []string{"pg_isready", "--quiet"}, nil, nil)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(pgPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("Postgres not ready after %s: %w", pgReadyTimeout, err)
+		}
+	}
+}
+
+// CheckIntegrity checks that every table of DefaultMinTableRows can be read
+// and holds at least the expected number of rows. If the database is missing
+// anything, the error wraps ErrCorruptDatabase and the report tells what is
+// wrong: restore a backup with RestoreDatabase, or rebuild pgdata as a last
+// resort.
+func (im *IchiranManager) CheckIntegrity(ctx context.Context) (*IntegrityReport, error) {
+	if !im.usesDocker() {
+		return nil, fmt.Errorf("integrity checks are only supported by the Docker backend")
+	}
+	tables := slices.Sorted(maps.Keys(DefaultMinTableRows))
+
+	var output bytes.Buffer
+	cmd := []string{"psql", "--no-psqlrc", "--quiet", "--tuples-only", "--no-align", "--field-separator= ",
+		"--set=ON_ERROR_STOP=1", "--dbname=" + ichiranDatabase, "--command=" + rowCountQuery(tables)}
+	err := im.execPg(ctx, cmd, nil, &output)
+
+	report := &IntegrityReport{}
+	var execErr *ExecError
+	switch {
+	case errors.As(err, &execErr):
+		// psql reports missing tables and unreadable pages alike
+		report.Problems = append(report.Problems, execErr.Stderr)
+	case err != nil:
+		return nil, fmt.Errorf("failed to check database: %w", err)
+	default:
+		if report.Rows, err = parseRowCounts(output.String()); err != nil {
+			return nil, err
+		}
+		report.Problems = checkRowCounts(report.Rows, DefaultMinTableRows)
+	}
+
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("%w: %s", ErrCorruptDatabase, strings.Join(report.Problems, "; "))
+	}
+	return report, nil
+}
+
+// rowCountQuery returns the SQL query counting the rows of each of tables, one
+// table per row
+func rowCountQuery(tables []string) string {
+	selects := make([]string, len(tables))
+	for i, table := range tables {
+		selects[i] = fmt.Sprintf("SELECT '%s', count(*) FROM %s", table, table)
+	}
+	return strings.Join(selects, " UNION ALL ")
+}
+
+// parseRowCounts parses the output of rowCountQuery printed by psql
+func parseRowCounts(output string) (map[string]int64, error) {
+	rows := make(map[string]int64)
+	for line := range strings.Lines(output) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		table, count, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected output of psql: %q", line)
+		}
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output of psql: %q", line)
+		}
+		rows[table] = n
+	}
+	return rows, nil
+}
+
+// checkRowCounts returns what is wrong with rows according to minimums
+func checkRowCounts(rows, minimums map[string]int64) (problems []string) {
+	for _, table := range slices.Sorted(maps.Keys(minimums)) {
+		n, ok := rows[table]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("table %s wasn't counted", table))
+		case n < minimums[table]:
+			problems = append(problems, fmt.Sprintf("table %s has %d rows, expected at least %d", table, n, minimums[table]))
+		}
+	}
+	return problems
+}
+
+// execPg runs cmd as the postgres user in the pg container, feeding it stdin
+// and copying its standard output to stdout, each if not nil. A failure of cmd
+// is reported as an *ExecError.
+func (im *IchiranManager) execPg(ctx context.Context, cmd []string, stdin io.Reader, stdout io.Writer) error {
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	name := im.pgContainerName()
+	containerInfo, err := client.ContainerInspect(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if !containerInfo.State.Running {
+		return fmt.Errorf("%w: %s", ErrContainerNotRunning, name)
+	}
+
+	exec, err := client.ContainerExecCreate(ctx, name, container.ExecOptions{
+		User:         "postgres",
+		Cmd:          cmd,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create exec: %w", err)
+	}
+	resp, err := client.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to attach to exec: %w", err)
+	}
+	defer resp.Close()
+	stop := context.AfterFunc(ctx, func() { resp.Close() })
+	defer stop()
+
+	if stdin != nil {
+		go func() {
+			if _, err := io.Copy(resp.Conn, stdin); err != nil {
+				Logger.Debug().Err(err).Msg("failed to send input to exec")
+			}
+			resp.CloseWrite()
+		}()
+	}
+
+	var stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(stdout, &stderr, resp.Reader); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to read exec output: %w", err)
+	}
+
+	inspect, err := client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect exec: %w", err)
+	}
+	if inspect.ExitCode != 0 {
+		return &ExecError{ExitCode: inspect.ExitCode, Stderr: strings.TrimSpace(stderr.String())}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package ichiran
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRowCounts(t *testing.T) {
+	query := rowCountQuery([]string{"entry", "gloss"})
+	assert.Equal(t, "SELECT 'entry', count(*) FROM entry UNION ALL SELECT 'gloss', count(*) FROM gloss", query)
+
+	rows, err := parseRowCounts("entry 212345\ngloss 42\n\n")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"entry": 212345, "gloss": 42}, rows)
+
+	_, err = parseRowCounts("entry many\n")
+	assert.ErrorContains(t, err, "unexpected output")
+
+	minimums := map[string]int64{"entry": 100000, "gloss": 100000, "sense": 1}
+	assert.Equal(t, []string{
+		"table gloss has 42 rows, expected at least 100000",
+		"table sense wasn't counted",
+	}, checkRowCounts(rows, minimums))
+	assert.Empty(t, checkRowCounts(map[string]int64{"entry": 100000, "gloss": 200000, "sense": 1}, minimums))
+}
+
+// TestBackupRestore backs up the database, empties a table behind the manager's
+// back, detects it with CheckIntegrity then restores the backup.
+func TestBackupRestore(t *testing.T) {
+	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
+		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
+	}
+	ctx := context.Background()
+	manager, err := NewManager(ctx)
+	require.NoError(t, err)
+	require.NoError(t, manager.Init(ctx))
+	defer manager.Close()
+
+	report, err := manager.CheckIntegrity(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	path := filepath.Join(t.TempDir(), "jmdict.dump")
+	require.NoError(t, manager.BackupDatabase(ctx, path))
+
+	require.NoError(t, manager.execPg(ctx, []string{"psql", "--dbname=" + ichiranDatabase, "--command=DELETE FROM gloss"}, nil, nil))
+	report, err = manager.CheckIntegrity(ctx)
+	assert.ErrorIs(t, err, ErrCorruptDatabase)
+	assert.Equal(t, int64(0), report.Rows["gloss"])
+
+	require.NoError(t, manager.RestoreDatabase(ctx, path))
+	tokens, err := manager.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	assert.NotEmpty(t, (*tokens)[0].Gloss)
+}
+
+// TestRestoreSequence checks that the restore runs with pg alone and that both
+// containers are running again afterwards, even if it failed.
+func TestRestoreSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jmdict.dump")
+	require.NoError(t, os.WriteFile(path, []byte(pgDumpMagic+"dump"), 0644))
+
+	for _, tt := range []struct {
+		name     string
+		exitCode int
+		wantErr  string
+	}{
+		{name: "restored"},
+		{name: "restore failed", exitCode: 1, wantErr: "failed to restore database"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			im := newIchiranManager(WithDataDir(t.TempDir()))
+			f := newFakeDocker(t, im)
+			f.images = map[string]string{ghcrImageMain: "sha256:main", ghcrImagePg: "sha256:pg"}
+			require.NoError(t, im.Init(ctx))
+			f.takeEvents()
+
+			pg := im.pgContainerName()
+			f.run = func(name string, cmd []string, stdin string) (string, int) {
+				switch cmd[0] {
+				case "pg_restore":
+					assert.False(t, f.container(im.containerName).running, "main is stopped during the restore")
+					assert.Equal(t, pgDumpMagic+"dump", stdin)
+					return "", tt.exitCode
+				case "psql":
+					var rows strings.Builder
+					for table, n := range DefaultMinTableRows {
+						fmt.Fprintf(&rows, "%s %d\n", table, n)
+					}
+					return rows.String(), 0
+				}
+				return "", 0
+			}
+
+			err := im.RestoreDatabase(ctx, path)
+			want := []string{"stop", "start " + pg, "exec " + pg + " pg_isready", "exec " + pg + " pg_restore", "stop", "init"}
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				want = append(want, "exec "+pg+" psql")
+			}
+			assert.Equal(t, want, f.takeEvents())
+			assert.True(t, f.container(im.containerName).running)
+			assert.True(t, f.container(pg).running)
+		})
+	}
+}
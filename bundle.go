@@ -0,0 +1,484 @@
+package ichiran
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// Layout of a bundle, a gzipped tarball holding, in this order:
+//   - manifest.json: the images of the bundle, see bundleManifest
+//   - secrets/postgres-password: the password pgdata was initialized with
+//   - pgdata/...: the pgdata directory of the data dir
+//   - images/...: both images in docker save format
+const (
+	bundleVersion      = 1
+	bundleManifestName = "manifest.json"
+	bundleImagesPrefix = "images/"
+	bundlePgdataPrefix = "pgdata/"
+)
+
+// importedImagesFile is the file of the data directory recording the images of
+// the bundle imported into it, see imageRefs
+const importedImagesFile = "imported-images.json"
+
+// imageRefs are the references of the images of both containers
+type imageRefs struct {
+	Main string `json:"main"`
+	Pg   string `json:"pg"`
+}
+
+// bundleManifest describes the content of a bundle
+type bundleManifest struct {
+	Version int         `json:"version"`
+	Created time.Time   `json:"created"`
+	Main    bundleImage `json:"main"`
+	Pg      bundleImage `json:"pg"`
+}
+
+// bundleImage identifies an image saved in a bundle
+type bundleImage struct {
+	Reference string `json:"reference"`
+	ID        string `json:"id"`
+}
+
+// ExportBundle writes to path a bundle of both images and of a snapshot of
+// pgdata, from which ImportBundle sets up the same install on a machine without
+// network access. The containers are stopped while pgdata is copied, so that
+// the snapshot is consistent, then started again. The bundle holds the whole
+// database and the Postgres password: handle it like the data directory.
+func (im *IchiranManager) ExportBundle(ctx context.Context, path string) error {
+	if !im.usesDocker() {
+		return fmt.Errorf("bundles are only supported by the Docker backend")
+	}
+	return im.withoutRecovery(ctx, func() error { return im.exportBundle(ctx, path) })
+}
+
+// exportBundle does the work of ExportBundle
+func (im *IchiranManager) exportBundle(ctx context.Context, path string) (err error) {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	mainImage, pgImage := im.runningImages()
+	manifest := bundleManifest{
+		Version: bundleVersion,
+		Created: time.Now().UTC(),
+		Main:    bundleImage{Reference: mainImage},
+		Pg:      bundleImage{Reference: pgImage},
+	}
+	if manifest.Main.ID, err = im.imageID(ctx, mainImage); err != nil {
+		return err
+	}
+	if manifest.Pg.ID, err = im.imageID(ctx, pgImage); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle manifest: %w", err)
+	}
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		if err := addTarFile(tw, bundleManifestName, data, 0644); err != nil {
+			return err
+		}
+		if err := addTarFile(tw, postgresPasswordFile, []byte(im.postgresPassword+"\n"), 0600); err != nil {
+			return err
+		}
+		if err := im.exportPgdata(ctx, tw); err != nil {
+			return err
+		}
+
+		images, err := client.ImageSave(ctx, []string{mainImage, pgImage})
+		if err != nil {
+			return fmt.Errorf("failed to save images: %w", err)
+		}
+		defer images.Close()
+		if err := addTarStream(tw, images, bundleImagesPrefix); err != nil {
+			return fmt.Errorf("failed to bundle images: %w", err)
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// exportPgdata adds the pgdata of the stopped pg container to tw, then starts
+// the containers again
+func (im *IchiranManager) exportPgdata(ctx context.Context, tw *tar.Writer) (err error) {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	im.closeSession()
+	im.resetBackendVersion()
+	if err := im.docker.Stop(); err != nil {
+		return fmt.Errorf("failed to stop containers: %w", err)
+	}
+	defer func() {
+		if restartErr := im.docker.InitQuiet(); restartErr != nil && err == nil {
+			err = fmt.Errorf("failed to restart containers: %w", restartErr)
+		}
+	}()
+
+	// The entries of the copy are relative to the mount point, as in the data dir
+	pgdata, _, err := client.CopyFromContainer(ctx, im.pgContainerName(), pgdataPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy pgdata: %w", err)
+	}
+	defer pgdata.Close()
+	if err := addTarStream(tw, pgdata, bundlePgdataPrefix); err != nil {
+		return fmt.Errorf("failed to bundle pgdata: %w", err)
+	}
+	return nil
+}
+
+// ImportBundle sets up the install of a bundle made by ExportBundle without
+// any network access: it loads the images, restores pgdata and the Postgres
+// password into the data directory then starts the containers. The images of
+// the bundle are recorded in the data directory: the managers created for it
+// later use them unless WithImages or WithRelease is given, and never pull
+// them. The pgdata directory of the data dir must be empty: import into a new
+// data directory or project. Like Upgrade, ImportBundle waits for the queries
+// in flight and the next ones wait for it.
+func (im *IchiranManager) ImportBundle(ctx context.Context, path string) error {
+	if !im.usesDocker() {
+		return fmt.Errorf("bundles are only supported by the Docker backend")
+	}
+	return im.withoutRecovery(ctx, func() error { return im.importBundle(ctx, path) })
+}
+
+// importBundle does the work of ImportBundle
+func (im *IchiranManager) importBundle(ctx context.Context, path string) error {
+	dataDir := im.dataDir()
+	entries, err := os.ReadDir(filepath.Join(dataDir, "pgdata"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read pgdata: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("pgdata of %s isn't empty, refusing to overwrite it", dataDir)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+	manifest, err := readBundle(file, dataDir, func(images io.Reader) error {
+		return im.loadImages(ctx, images)
+	})
+	if err != nil {
+		return err
+	}
+
+	var imported imageRefs
+	if imported.Main, err = im.bundleReference(ctx, manifest.Main); err != nil {
+		return err
+	}
+	if imported.Pg, err = im.bundleReference(ctx, manifest.Pg); err != nil {
+		return err
+	}
+	if err := saveImportedImages(dataDir, imported); err != nil {
+		return err
+	}
+	im.imported = imported
+	im.mainImage, im.pgImage = imported.Main, imported.Pg
+	im.pinnedMainImage, im.pinnedPgImage = "", ""
+	im.postgresPassword = ""
+	if err := im.resolvePostgresPassword(); err != nil {
+		return err
+	}
+	im.closeSession()
+	if err := im.reconfigureDocker(ctx); err != nil {
+		return err
+	}
+	return im.docker.InitRecreate()
+}
+
+// saveImportedImages records images in dataDir as those of the bundle imported into it
+func saveImportedImages(dataDir string, images imageRefs) error {
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode imported images: %w", err)
+	}
+	err = writeFileAtomic(filepath.Join(dataDir, importedImagesFile), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record imported images: %w", err)
+	}
+	return nil
+}
+
+// loadImportedImages reads the images of the bundle imported into the data
+// directory, if any, and uses them unless WithImages or WithRelease chose others
+func (im *IchiranManager) loadImportedImages() error {
+	data, err := os.ReadFile(filepath.Join(im.dataDir(), importedImagesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read imported images: %w", err)
+	}
+	if err := json.Unmarshal(data, &im.imported); err != nil {
+		return fmt.Errorf("failed to decode imported images: %w", err)
+	}
+	if !im.imagesSet {
+		im.mainImage, im.pgImage = im.imported.Main, im.imported.Pg
+	}
+	return nil
+}
+
+// offline tells whether the containers run the images of an imported bundle,
+// which only exist locally and are never pulled
+func (im *IchiranManager) offline() bool {
+	main, pg := im.runningImages()
+	return im.imported.Main != "" && main == im.imported.Main && pg == im.imported.Pg
+}
+
+// loadImages loads into Docker the images of r, in docker save format
+func (im *IchiranManager) loadImages(ctx context.Context, r io.Reader) error {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	resp, err := client.ImageLoad(ctx, r)
+	if err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		_, err = io.Copy(io.Discard, resp.Body)
+	} else {
+		err = jsonmessage.DisplayJSONMessagesStream(resp.Body, io.Discard, 0, false, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+	return nil
+}
+
+// bundleReference returns a reference to the loaded image of a bundle. Images
+// saved by digest lose their reference: they are tagged locally instead.
+func (im *IchiranManager) bundleReference(ctx context.Context, img bundleImage) (string, error) {
+	if id, err := im.imageID(ctx, img.Reference); err == nil && id == img.ID {
+		return img.Reference, nil
+	}
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	tag := repositoryOf(img.Reference) + ":bundle-" + strings.TrimPrefix(img.ID, "sha256:")[:12]
+	if err := client.ImageTag(ctx, img.ID, tag); err != nil {
+		return "", fmt.Errorf("failed to tag image %s: %w", img.ID, err)
+	}
+	return tag, nil
+}
+
+// readBundle reads a bundle from r: the images are passed to loadImages as a
+// stream in docker save format, everything else is extracted into dataDir
+func readBundle(r io.Reader, dataDir string, loadImages func(io.Reader) error) (_ *bundleManifest, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != bundleManifestName {
+		return nil, fmt.Errorf("not a bundle: missing %s", bundleManifestName)
+	}
+	var manifest bundleManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode bundle manifest: %w", err)
+	}
+	if manifest.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	var loader *imageLoader
+	defer func() {
+		if err != nil && loader != nil {
+			loader.abort(err)
+		}
+	}()
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if name, ok := strings.CutPrefix(header.Name, bundleImagesPrefix); ok {
+			if loader == nil {
+				loader = newImageLoader(loadImages)
+			}
+			if err := loader.add(name, header, tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := extractTarEntry(dataDir, header, tr); err != nil {
+			return nil, err
+		}
+	}
+	if loader == nil {
+		return nil, fmt.Errorf("bundle holds no images")
+	}
+	if err := loader.close(); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// imageLoader streams the image entries of a bundle to loadImages as a tarball
+type imageLoader struct {
+	pw   *io.PipeWriter
+	tw   *tar.Writer
+	done chan struct{}
+	err  error // Error of loadImages, set once done is closed
+}
+
+func newImageLoader(loadImages func(io.Reader) error) *imageLoader {
+	pr, pw := io.Pipe()
+	l := &imageLoader{pw: pw, tw: tar.NewWriter(pw), done: make(chan struct{})}
+	go func() {
+		l.err = loadImages(pr)
+		// Unblock the writer if loadImages gave up early
+		pr.CloseWithError(errors.Join(l.err, io.ErrClosedPipe))
+		close(l.done)
+	}()
+	return l
+}
+
+// add writes the entry name of the images
+func (l *imageLoader) add(name string, header *tar.Header, r io.Reader) error {
+	header.Name = name
+	err := l.tw.WriteHeader(header)
+	if err == nil {
+		_, err = io.Copy(l.tw, r)
+	}
+	if err != nil {
+		l.abort(err)
+		if l.err != nil {
+			return l.err
+		}
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+	return nil
+}
+
+// close ends the stream of images and waits until they are loaded
+func (l *imageLoader) close() error {
+	err := l.tw.Close()
+	l.pw.CloseWithError(err)
+	<-l.done
+	if l.err != nil {
+		return l.err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+	return nil
+}
+
+// abort interrupts the loading of the images and waits until loadImages returned
+func (l *imageLoader) abort(err error) {
+	l.pw.CloseWithError(err)
+	<-l.done
+}
+
+// extractTarEntry creates in dir the file or directory of header
+func extractTarEntry(dir string, header *tar.Header, r io.Reader) error {
+	name := path.Clean(strings.TrimSuffix(header.Name, "/"))
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("invalid path in bundle: %s", header.Name)
+	}
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	mode := header.FileInfo().Mode().Perm()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0700); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		return os.Chmod(target, mode)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		_, err = io.Copy(file, r)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		return os.Chtimes(target, header.ModTime, header.ModTime)
+	default:
+		return fmt.Errorf("unsupported entry in bundle: %s", header.Name)
+	}
+}
+
+// addTarFile adds to tw a file name holding data
+func addTarFile(tw *tar.Writer, name string, data []byte, mode int64) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// addTarStream adds to tw the entries of the tarball r, prefixing their names
+func addTarStream(tw *tar.Writer, r io.Reader, prefix string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header.Name = prefix + header.Name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package ichiran
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/compose-spec/compose-go/v2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tarball returns a tarball of the given files, directories ending with '/'
+func tarball(t *testing.T, files map[string]string, names ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg, Size: int64(len(files[name]))}
+		if name[len(name)-1] == '/' {
+			header = &tar.Header{Name: name, Mode: 0700, Typeflag: tar.TypeDir}
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// testBundle returns a bundle made of the given parts, like ExportBundle does
+func testBundle(t *testing.T, manifest *bundleManifest, pgdata, images []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if manifest != nil {
+		data, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		require.NoError(t, addTarFile(tw, bundleManifestName, data, 0644))
+	}
+	require.NoError(t, addTarFile(tw, postgresPasswordFile, []byte("s3cret\n"), 0600))
+	require.NoError(t, addTarStream(tw, bytes.NewReader(pgdata), bundlePgdataPrefix))
+	require.NoError(t, addTarStream(tw, bytes.NewReader(images), bundleImagesPrefix))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestReadBundle(t *testing.T) {
+	manifest := &bundleManifest{
+		Version: bundleVersion,
+		Main:    bundleImage{Reference: ghcrImageMain, ID: "sha256:1111"},
+		Pg:      bundleImage{Reference: ghcrImagePg, ID: "sha256:2222"},
+	}
+	pgdata := tarball(t, map[string]string{"pgdata/PG_VERSION": "16", "pgdata/base/1/1259": "rows"},
+		"pgdata/", "pgdata/PG_VERSION", "pgdata/base/", "pgdata/base/1/", "pgdata/base/1/1259")
+	images := tarball(t, map[string]string{"manifest.json": "[]", "blobs/sha256/1111": "layer"},
+		"manifest.json", "blobs/", "blobs/sha256/", "blobs/sha256/1111")
+
+	t.Run("complete", func(t *testing.T) {
+		dataDir := t.TempDir()
+		var loaded []byte
+		got, err := readBundle(bytes.NewReader(testBundle(t, manifest, pgdata, images)), dataDir, func(r io.Reader) error {
+			var err error
+			loaded, err = io.ReadAll(r)
+			return err
+		})
+		require.NoError(t, err)
+		assert.Equal(t, manifest.Main, got.Main)
+		assert.Equal(t, manifest.Pg, got.Pg)
+
+		// The images are streamed as they were saved
+		tr := tar.NewReader(bytes.NewReader(loaded))
+		var names []string
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, header.Name)
+		}
+		assert.Equal(t, []string{"manifest.json", "blobs/", "blobs/sha256/", "blobs/sha256/1111"}, names)
+
+		// Everything else lands in the data dir
+		data, err := os.ReadFile(filepath.Join(dataDir, "pgdata", "pgdata", "base", "1", "1259"))
+		require.NoError(t, err)
+		assert.Equal(t, "rows", string(data))
+		info, err := os.Stat(filepath.Join(dataDir, "pgdata", "pgdata"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		im := newIchiranManager(WithDataDir(dataDir), WithImages(customMainImage, ""))
+		require.NoError(t, im.resolvePostgresPassword())
+		assert.Equal(t, "s3cret", im.postgresPassword)
+	})
+
+	t.Run("failed loading", func(t *testing.T) {
+		errLoad := errors.New("no space left on device")
+		_, err := readBundle(bytes.NewReader(testBundle(t, manifest, pgdata, images)), t.TempDir(), func(r io.Reader) error {
+			return errLoad
+		})
+		assert.ErrorIs(t, err, errLoad)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		load := func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		_, err := readBundle(bytes.NewReader(testBundle(t, nil, pgdata, images)), t.TempDir(), load)
+		assert.ErrorContains(t, err, "not a bundle")
+
+		future := *manifest
+		future.Version = bundleVersion + 1
+		_, err = readBundle(bytes.NewReader(testBundle(t, &future, pgdata, images)), t.TempDir(), load)
+		assert.ErrorContains(t, err, "unsupported bundle version")
+
+		dataDir := t.TempDir()
+		escaping := tarball(t, map[string]string{"../../outside": "x"}, "../../outside")
+		_, err = readBundle(bytes.NewReader(testBundle(t, manifest, escaping, images)), dataDir, load)
+		assert.ErrorContains(t, err, "invalid path")
+		assert.NoFileExists(t, filepath.Join(filepath.Dir(dataDir), "outside"))
+
+		_, err = readBundle(bytes.NewReader(testBundle(t, manifest, pgdata, nil)), t.TempDir(), load)
+		assert.ErrorContains(t, err, "no images")
+	})
+}
+
+// TestBundleRoundTrip exports the install of a manager and imports it under
+// another project name
+func TestBundleRoundTrip(t *testing.T) {
+	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
+		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
+	}
+	ctx := context.Background()
+	manager, err := NewManager(ctx)
+	require.NoError(t, err)
+	require.NoError(t, manager.Init(ctx))
+	defer manager.Close()
+
+	path := filepath.Join(t.TempDir(), "ichiran.tar.gz")
+	require.NoError(t, manager.ExportBundle(ctx, path))
+
+	imported, err := NewManager(ctx, WithProjectName("ichiran-imported"), WithDataDir(t.TempDir()))
+	require.NoError(t, err)
+	require.NoError(t, imported.ImportBundle(ctx, path))
+	defer imported.docker.Down()
+
+	tokens, err := imported.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	assert.Equal(t, "konnichiha", (*tokens)[0].Romaji)
+}
+
+// TestImportBundleOffline checks that a bundle is imported, and its install
+// started again later, without pulling anything
+func TestImportBundleOffline(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mainID, pgID := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	manifest := &bundleManifest{
+		Version: bundleVersion,
+		Main:    bundleImage{Reference: customMainImage, ID: mainID},
+		Pg:      bundleImage{Reference: ghcrImagePg, ID: pgID},
+	}
+	pgdata := tarball(t, map[string]string{"pgdata/PG_VERSION": "16"}, "pgdata/", "pgdata/PG_VERSION")
+	images := tarball(t, map[string]string{"manifest.json": "[]"}, "manifest.json")
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	require.NoError(t, os.WriteFile(path, testBundle(t, manifest, pgdata, images), 0600))
+
+	im := newIchiranManager(WithDataDir(dir))
+	f := newFakeDocker(t, im)
+	f.noNetwork = true
+	f.loads = []string{mainID, pgID}
+	require.NoError(t, im.ImportBundle(ctx, path))
+
+	mainTag := "registry.example.com/ichiran-main:bundle-111111111111"
+	pgTag := ghcrRepoPg + ":bundle-222222222222"
+	assert.Equal(t, []string{"load", "tag " + mainTag, "tag " + pgTag, "stop", "configure " + mainTag + " " + pgTag, "recreate"}, f.takeEvents())
+	for _, service := range f.project.Services {
+		assert.Equal(t, types.PullPolicyNever, service.PullPolicy)
+	}
+	assert.Equal(t, mainID, f.container(im.containerName).imageID)
+	assert.Equal(t, pgID, f.container(im.pgContainerName()).imageID)
+
+	t.Run("later managers", func(t *testing.T) {
+		require.NoError(t, f.Stop())
+		later, err := NewManager(ctx, WithDataDir(dir))
+		require.NoError(t, err)
+		require.NoError(t, later.Init(ctx))
+		require.NoError(t, later.PullImages(ctx))
+		assert.Equal(t, []string{"stop", "configure " + mainTag + " " + pgTag, "init"}, f.takeEvents())
+		assert.True(t, f.container(later.containerName).running)
+	})
+
+	t.Run("other images", func(t *testing.T) {
+		other, err := NewManager(ctx, WithDataDir(dir), WithImages(customMainImage, ""))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"configure " + customMainImage + " " + ghcrImagePg}, f.takeEvents())
+		assert.Empty(t, f.project.Services["main"].PullPolicy, "images chosen explicitly are pulled")
+		assert.False(t, other.offline())
+	})
+}
+
+// TestImportBundleWaitsForQueries checks that ImportBundle, which replaces the
+// images and the Docker manager, leaves them alone until the query in flight
+// is answered.
+func TestImportBundleWaitsForQueries(t *testing.T) {
+	ctx := context.Background()
+	mainID, pgID := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	manifest := &bundleManifest{
+		Version: bundleVersion,
+		Main:    bundleImage{Reference: customMainImage, ID: mainID},
+		Pg:      bundleImage{Reference: ghcrImagePg, ID: pgID},
+	}
+	pgdata := tarball(t, map[string]string{"pgdata/PG_VERSION": "16"}, "pgdata/", "pgdata/PG_VERSION")
+	images := tarball(t, map[string]string{"manifest.json": "[]"}, "manifest.json")
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	require.NoError(t, os.WriteFile(path, testBundle(t, manifest, pgdata, images), 0600))
+
+	im := newIchiranManager(WithDataDir(t.TempDir()))
+	f := newFakeDocker(t, im)
+	f.images = map[string]string{ghcrImageMain: "sha256:main-1", ghcrImagePg: "sha256:pg-1"}
+	f.loads = []string{mainID, pgID}
+	querying, answer := make(chan struct{}), make(chan struct{})
+	f.run = func(name string, cmd []string, stdin string) (string, int) {
+		close(querying)
+		<-answer
+		return konnichihaJSON, 0
+	}
+	require.NoError(t, im.Init(ctx))
+	f.takeEvents()
+
+	analyzed := make(chan error)
+	go func() {
+		_, err := im.Analyze(ctx, "こんにちは")
+		analyzed <- err
+	}()
+	<-querying
+	imported := make(chan error)
+	go func() { imported <- im.ImportBundle(ctx, path) }()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-imported:
+		t.Fatalf("import didn't wait for the query in flight: %v", err)
+	default:
+	}
+	assert.Equal(t, []string{"exec " + im.containerName + " bash"}, f.takeEvents(), "only the query ran")
+
+	close(answer)
+	require.NoError(t, <-analyzed)
+	require.NoError(t, <-imported)
+	assert.Contains(t, f.takeEvents(), "load")
+	assert.Equal(t, mainID, f.container(im.containerName).imageID)
+}
@@ -0,0 +1,357 @@
+package ichiran
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultCacheMaxBytes is the size limit of the analysis cache when none is given to WithCache
+var DefaultCacheMaxBytes int64 = 256 << 20
+
+// CacheStats tells how the analysis cache of a manager performed
+type CacheStats struct {
+	Hits      int   // Queries answered by the cache
+	Misses    int   // Queries that had to be sent to ichiran
+	Evictions int   // Entries removed to keep the cache under its size limit
+	Entries   int   // Number of entries currently cached
+	Bytes     int64 // Total size of the entries currently cached
+}
+
+// WithCache keeps the JSON output of ichiran for each query on disk, in dir or
+// in the "cache" directory next to the compose files if dir is empty, so that a
+// text analyzed once is never sent to ichiran again, even across runs.
+// Entries are keyed by the query, its texts trimmed and NFC-normalized, the
+// ichiran image and SnippetVersion: updating the image (and its dictionary) or
+// this package invalidates them. When the cache grows over maxBytes
+// (DefaultCacheMaxBytes if not positive), the least recently used entries are
+// evicted.
+func WithCache(dir string, maxBytes int64) ManagerOption {
+	return func(im *IchiranManager) {
+		if maxBytes <= 0 {
+			maxBytes = DefaultCacheMaxBytes
+		}
+		im.cache = newDiskCache(dir, maxBytes)
+	}
+}
+
+// CacheStats returns the statistics of the analysis cache, zero if WithCache isn't used
+func (im *IchiranManager) CacheStats() CacheStats {
+	if im.cache == nil {
+		return CacheStats{}
+	}
+	return im.cache.Stats()
+}
+
+// ClearCache removes all the entries of the analysis cache
+func (im *IchiranManager) ClearCache() error {
+	if im.cache == nil {
+		return nil
+	}
+	return im.cache.clear()
+}
+
+// normalizeText returns text trimmed and NFC-normalized, see queryText
+func normalizeText(text string) string {
+	return norm.NFC.String(strings.TrimSpace(text))
+}
+
+// queryText returns what is sent to ichiran to analyze text. With WithCache,
+// that's the normalized text so that the texts only differing by surrounding
+// whitespace or by their Unicode normalization form share their entries, the
+// tokens being realigned with each text afterwards, see realignTokens.
+func (im *IchiranManager) queryText(text string) string {
+	if im.cache == nil {
+		return text
+	}
+	return normalizeText(text)
+}
+
+// realignTokens moves the offsets of tokens, aligned with query, the normalized
+// text, onto text, the input query was normalized from. Surrounding whitespace
+// becomes gaps and the surfaces of aligned tokens are replaced by the spans of
+// text they cover, which only differ by their normalization form.
+func realignTokens(text, query string, tokens JSONTokens) {
+	if text == query {
+		return
+	}
+
+	// Offsets of query and text at the boundaries of the normalized segments
+	lead := len(text) - len(strings.TrimLeftFunc(text, unicode.IsSpace))
+	queryOffsets, textOffsets := []int{0}, []int{lead}
+	var it norm.Iter
+	it.InitString(norm.NFC, strings.TrimSpace(text))
+	for q := 0; !it.Done(); {
+		q += len(it.Next())
+		queryOffsets = append(queryOffsets, q)
+		textOffsets = append(textOffsets, lead+it.Pos())
+	}
+
+	for _, token := range tokens {
+		realignToken(text, queryOffsets, textOffsets, token)
+	}
+}
+
+// realignToken moves the offsets of token and recursively of its components and
+// alternatives, see realignTokens. An offset within a segment is moved to its end.
+func realignToken(text string, queryOffsets, textOffsets []int, token *JSONToken) {
+	move := func(offset int) int {
+		i, _ := slices.BinarySearch(queryOffsets, offset)
+		return textOffsets[min(i, len(textOffsets)-1)]
+	}
+	token.StartByte, token.EndByte = move(token.StartByte), move(token.EndByte)
+	token.Start = utf8.RuneCountInString(text[:token.StartByte])
+	token.End = token.Start + utf8.RuneCountInString(text[token.StartByte:token.EndByte])
+	if !token.Unaligned {
+		token.Surface = text[token.StartByte:token.EndByte]
+	}
+
+	for i := range token.Components {
+		realignToken(text, queryOffsets, textOffsets, &token.Components[i])
+	}
+	for i := range token.Alternative {
+		realignToken(text, queryOffsets, textOffsets, &token.Alternative[i])
+	}
+}
+
+// cacheKey returns the key of form in the analysis cache
+func (im *IchiranManager) cacheKey(ctx context.Context, form string) (string, error) {
+	version, err := im.backendVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(version + "\n" + SnippetVersion + "\n" + form))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// backendVersion identifies what answers the queries: the image of the main
+// container or, for the native backend, the ichiran-cli executable and its
+// modification time. It is computed once and reset whenever the containers may
+// be recreated.
+func (im *IchiranManager) backendVersion(ctx context.Context) (string, error) {
+	im.versionMu.Lock()
+	defer im.versionMu.Unlock()
+	if im.version != "" {
+		return im.version, nil
+	}
+
+	if im.isNative() {
+		path, err := exec.LookPath(im.nativeCommand)
+		if err != nil {
+			return "", fmt.Errorf("ichiran-cli not found for the native backend: %w", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat ichiran-cli: %w", err)
+		}
+		im.version = fmt.Sprintf("native:%s:%d", path, info.ModTime().UnixNano())
+		return im.version, nil
+	}
+
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	containerInfo, err := client.ContainerInspect(ctx, im.containerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container: %w", err)
+	}
+	im.version = containerInfo.Image
+	return im.version, nil
+}
+
+// resetBackendVersion makes the next query check which image it is answered by
+func (im *IchiranManager) resetBackendVersion() {
+	im.versionMu.Lock()
+	defer im.versionMu.Unlock()
+	im.version = ""
+}
+
+// diskCache stores one file per entry in dir. The index of the entries is
+// loaded from dir on first use: the modification time of a file is the last
+// time its entry was used.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry // nil until loaded
+	bytes   int64
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+const cacheFileExt = ".json"
+
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	return &diskCache{dir: dir, maxBytes: maxBytes}
+}
+
+// load indexes the entries found in the cache directory. It must be called with mu held.
+func (c *diskCache) load() error {
+	if c.entries != nil {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	c.entries = make(map[string]*cacheEntry, len(files))
+	for _, file := range files {
+		key, ok := strings.CutSuffix(file.Name(), cacheFileExt)
+		if !ok || file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[key] = &cacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		c.bytes += info.Size()
+	}
+	return nil
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key+cacheFileExt)
+}
+
+// get returns the entry of key, if cached
+func (c *diskCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		Logger.Debug().Err(err).Msg("analysis cache unavailable")
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		// Removed behind our back
+		c.forget(key)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry.lastUsed = time.Now()
+	os.Chtimes(c.path(key), entry.lastUsed, entry.lastUsed)
+	c.stats.Hits++
+	return data, true
+}
+
+// put caches data as the entry of key, evicting the least recently used entries
+// if needed. Entries bigger than the size limit are not cached.
+func (c *diskCache) put(key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return nil
+	}
+
+	// A concurrent process never reads a partial entry
+	err := writeFileAtomic(c.path(key), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+
+	c.forget(key)
+	c.entries[key] = &cacheEntry{size: size, lastUsed: time.Now()}
+	c.bytes += size
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits its size limit
+func (c *diskCache) evict() {
+	if c.bytes <= c.maxBytes {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return c.entries[a].lastUsed.Compare(c.entries[b].lastUsed)
+	})
+	for _, key := range keys {
+		if c.bytes <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(c.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			Logger.Debug().Err(err).Msg("failed to evict cache entry")
+			continue
+		}
+		c.forget(key)
+		c.stats.Evictions++
+	}
+}
+
+// forget removes key from the index
+func (c *diskCache) forget(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.bytes -= entry.size
+		delete(c.entries, key)
+	}
+}
+
+// clear removes all the entries, including those added by other processes
+// since the index was loaded
+func (c *diskCache) clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries, c.bytes = nil, 0
+	if err := c.load(); err != nil {
+		return err
+	}
+	for key := range c.entries {
+		if err := os.Remove(c.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to clear cache: %w", err)
+		}
+		c.forget(key)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the cache
+func (c *diskCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	return stats
+}
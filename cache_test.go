@@ -0,0 +1,134 @@
+package ichiran
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	cacheDir := t.TempDir()
+	command, dir := stubCLI(t, konnichihaJSON)
+	queried := func() bool {
+		_, err := os.Stat(filepath.Join(dir, "form"))
+		os.Remove(filepath.Join(dir, "form"))
+		return err == nil
+	}
+
+	manager, err := NewManager(ctx, WithNativeBackend(command), WithCache(cacheDir, 0))
+	require.NoError(t, err)
+
+	first, err := manager.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	assert.True(t, queried())
+	second, err := manager.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	assert.False(t, queried(), "served by the cache")
+	assert.Equal(t, first, second)
+
+	_, err = manager.Analyze(ctx, "fail")
+	require.Error(t, err)
+	_, err = manager.Analyze(ctx, "fail")
+	require.Error(t, err)
+	assert.True(t, queried(), "failures are not cached")
+
+	stats := manager.CacheStats()
+	assert.Equal(t, 1, stats.Hits)
+	assert.Equal(t, 3, stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Positive(t, stats.Bytes)
+
+	t.Run("across runs", func(t *testing.T) {
+		manager, err := NewManager(ctx, WithNativeBackend(command), WithCache(cacheDir, 0))
+		require.NoError(t, err)
+		_, err = manager.Analyze(ctx, "こんにちは")
+		require.NoError(t, err)
+		assert.False(t, queried())
+		assert.Equal(t, CacheStats{Hits: 1, Entries: 1, Bytes: stats.Bytes}, manager.CacheStats())
+	})
+
+	t.Run("invalidated by an update of ichiran", func(t *testing.T) {
+		later := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(command, later, later))
+		manager, err := NewManager(ctx, WithNativeBackend(command), WithCache(cacheDir, 0))
+		require.NoError(t, err)
+		_, err = manager.Analyze(ctx, "こんにちは")
+		require.NoError(t, err)
+		assert.True(t, queried())
+		assert.Equal(t, 2, manager.CacheStats().Entries)
+	})
+
+	t.Run("normalized text", func(t *testing.T) {
+		command, dir := stubCLI(t, gakkouJSON)
+		manager, err := NewManager(ctx, WithNativeBackend(command), WithCache(t.TempDir(), 0))
+		require.NoError(t, err)
+
+		decomposed := " \u304b\u3099っこう\n" // か and a combining dakuten
+		tokens, err := manager.Analyze(ctx, decomposed)
+		require.NoError(t, err)
+		form, err := os.ReadFile(filepath.Join(dir, "form"))
+		require.NoError(t, err)
+		assert.Equal(t, analyzeForm("\u304cっこう", 1), string(form), "the normalized text is analyzed")
+		require.NoError(t, tokens.VerifyOffsets(decomposed))
+		assert.Equal(t, []string{" ", "\n"}, []string{tokens.Gaps(decomposed)[0], tokens.Gaps(decomposed)[1]})
+		assert.False(t, (*tokens)[0].Unaligned)
+
+		require.NoError(t, os.Remove(filepath.Join(dir, "form")))
+		precomposed := "\u304cっこう"
+		tokens, err = manager.Analyze(ctx, precomposed)
+		require.NoError(t, err)
+		_, err = os.Stat(filepath.Join(dir, "form"))
+		assert.ErrorIs(t, err, os.ErrNotExist, "served by the cache")
+		require.NoError(t, tokens.VerifyOffsets(precomposed))
+		assert.Equal(t, 1, manager.CacheStats().Entries)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		require.NoError(t, manager.ClearCache())
+		assert.Equal(t, 0, manager.CacheStats().Entries)
+		files, err := os.ReadDir(cacheDir)
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	cache := newDiskCache(t.TempDir(), 12)
+
+	require.NoError(t, cache.put("a", []byte("aaaaaa")))
+	require.NoError(t, cache.put("b", []byte("bbbbbb")))
+	_, ok := cache.get("a")
+	require.True(t, ok)
+
+	// b is the least recently used
+	require.NoError(t, cache.put("c", []byte("cccccc")))
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	data, ok := cache.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "aaaaaa", string(data))
+
+	// Too big to be cached at all
+	require.NoError(t, cache.put("d", []byte("ddddddddddddd")))
+	_, ok = cache.get("d")
+	assert.False(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, 1, stats.Evictions)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(12), stats.Bytes)
+
+	// The index is rebuilt from the directory
+	reopened := newDiskCache(cache.dir, 12)
+	_, ok = reopened.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 2, reopened.Stats().Entries)
+}
+
+const gakkouJSON = `[[[[["gakkou",{"type":"KANA","text":"\u304cっこう","kana":"\u304cっこう","score":300,"seq":1206250,"gloss":{"reading":"がっこう","gloss":[{"pos":"[n]","gloss":"school"}]}},[]]],300]]]`
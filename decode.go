@@ -0,0 +1,241 @@
+package ichiran
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The types below mirror the JSON produced by the analysis form, that is
+// romanize* serialized by jsown, see lispPrelude:
+//
+//	[fragment, ...]                         rawAnalysis
+//	fragment: "text" | [segmentation, ...]  rawFragment
+//	segmentation: [[word entry, ...], score] rawSegmentation
+//	word entry: ["romaji", {word}, [...]]   rawWordEntry
+//	word: {"type": ..., "text": ..., ...}   rawWord
+//
+// ichiran mixes arrays of heterogeneous elements with objects, hence the custom
+// UnmarshalJSON methods. Unknown object keys are ignored but any value that
+// doesn't have the expected shape is an error telling where it was found.
+
+// rawAnalysis is the output of romanize*: the fragments of the text, in order
+type rawAnalysis []rawFragment
+
+func (a *rawAnalysis) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return badValue(data, fmt.Errorf("analysis: expected an array of fragments: %w", err))
+	}
+	*a = make(rawAnalysis, len(items))
+	for i, item := range items {
+		if err := json.Unmarshal(item, &(*a)[i]); err != nil {
+			return fmt.Errorf("fragment %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// rawFragment is either some text ichiran didn't analyze (punctuation,
+// whitespace, non-Japanese text...) or the segmentations of a Japanese fragment,
+// best first.
+type rawFragment struct {
+	Text          string
+	IsText        bool
+	Segmentations []rawSegmentation
+}
+
+func (f *rawFragment) UnmarshalJSON(data []byte) error {
+	switch firstByte(data) {
+	case '"':
+		f.IsText = true
+		return json.Unmarshal(data, &f.Text)
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return badValue(data, err)
+		}
+		f.Segmentations = make([]rawSegmentation, len(items))
+		for i, item := range items {
+			if err := json.Unmarshal(item, &f.Segmentations[i]); err != nil {
+				return fmt.Errorf("segmentation %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+	return badValue(data, fmt.Errorf("expected a string or an array of segmentations, got %s", snippet(data)))
+}
+
+// rawSegmentation is one way to split a Japanese fragment into words
+type rawSegmentation struct {
+	Entries []rawWordEntry
+	Score   int
+}
+
+func (s *rawSegmentation) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil || len(items) != 2 {
+		return badValue(data, fmt.Errorf("expected [[word entries...], score], got %s", snippet(data)))
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(items[0], &entries); err != nil {
+		return badValue(items[0], fmt.Errorf("expected an array of word entries, got %s", snippet(items[0])))
+	}
+	s.Entries = make([]rawWordEntry, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal(entry, &s.Entries[i]); err != nil {
+			return fmt.Errorf("word entry %d: %w", i, err)
+		}
+	}
+	var score flexInt
+	if err := json.Unmarshal(items[1], &score); err != nil {
+		return fmt.Errorf("score: %w", err)
+	}
+	s.Score = int(score)
+	return nil
+}
+
+// rawWordEntry is a word of a segmentation along with its romanization
+type rawWordEntry struct {
+	Romaji string
+	Word   rawWord
+}
+
+func (e *rawWordEntry) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil || len(items) < 2 ||
+		firstByte(items[0]) != '"' || firstByte(items[1]) != '{' {
+		return badValue(data, fmt.Errorf("expected [\"romaji\", {word}, ...], got %s", snippet(data)))
+	}
+	if err := json.Unmarshal(items[0], &e.Romaji); err != nil {
+		return fmt.Errorf("romaji: %w", err)
+	}
+	return json.Unmarshal(items[1], &e.Word)
+}
+
+// rawWord is a word as serialized by go-ichiran-word-json. A word with
+// alternative interpretations only holds them, in Alternative.
+type rawWord struct {
+	Type        string         `json:"type"`
+	Text        string         `json:"text"`
+	Kana        flexString     `json:"kana"`
+	Romaji      string         `json:"romaji"`
+	Reading     string         `json:"reading"`
+	Score       flexInt        `json:"score"`
+	Seq         flexInt        `json:"seq"`
+	Gloss       rawGloss       `json:"gloss"`
+	Conj        []Conj         `json:"conj"`
+	Match       []KanjiReading `json:"match"`
+	Compound    []string       `json:"compound"`
+	Components  []rawWord      `json:"components"`
+	Alternative []rawWord      `json:"alternative"`
+
+	raw json.RawMessage
+}
+
+func (w *rawWord) UnmarshalJSON(data []byte) error {
+	// plain has the fields of rawWord but not its methods
+	type plain rawWord
+	if err := json.Unmarshal(data, (*plain)(w)); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return badValue(data, fmt.Errorf("word %s: field %q: expected %s, got JSON %s", snippet(data), typeErr.Field, typeErr.Type, typeErr.Value))
+		}
+		return badValue(data, fmt.Errorf("word %s: %w", snippet(data), err))
+	}
+	w.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// rawGloss holds the glosses of a word, given by ichiran either as an array or,
+// along with the reading, as an object {"reading": ..., "gloss": [...]}
+type rawGloss struct {
+	Reading string
+	Glosses []Gloss
+}
+
+func (g *rawGloss) UnmarshalJSON(data []byte) error {
+	switch firstByte(data) {
+	case 'n':
+		return nil
+	case '[':
+		return json.Unmarshal(data, &g.Glosses)
+	case '{':
+		var obj struct {
+			Reading string  `json:"reading"`
+			Gloss   []Gloss `json:"gloss"`
+		}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		g.Reading, g.Glosses = obj.Reading, obj.Gloss
+		return nil
+	}
+	return badValue(data, fmt.Errorf("expected an array or an object of glosses, got %s", snippet(data)))
+}
+
+// flexString is a string that ichiran may give as a list of strings, of which
+// the first is kept
+type flexString string
+
+func (s *flexString) UnmarshalJSON(data []byte) error {
+	switch firstByte(data) {
+	case 'n':
+		return nil
+	case '"':
+		return json.Unmarshal(data, (*string)(s))
+	case '[':
+		var list []string
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		if len(list) > 0 {
+			*s = flexString(list[0])
+		}
+		return nil
+	}
+	return badValue(data, fmt.Errorf("expected a string, got %s", snippet(data)))
+}
+
+// flexInt is a number that ichiran may give as a list of numbers (e.g. the
+// sequence numbers of the words of a compound), of which the first is kept
+type flexInt int
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	switch firstByte(data) {
+	case 'n':
+		return nil
+	case '[':
+		var list []flexInt
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		if len(list) > 0 {
+			*n = list[0]
+		}
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return badValue(data, fmt.Errorf("expected a number, got %s", snippet(data)))
+	}
+	*n = flexInt(f)
+	return nil
+}
+
+// firstByte returns the first non-whitespace byte of data, which tells the
+// type of the JSON value
+func firstByte(data []byte) byte {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 {
+		return 0
+	}
+	return data[0]
+}
+
+// snippet returns the beginning of data for error messages
+func snippet(data []byte) string {
+	return strings.ToValidUTF8(stringCapLen(string(bytes.TrimSpace(data)), 80), "")
+}
@@ -0,0 +1,160 @@
+package ichiran
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+// goldenToken is the view of a token stored in golden files: all the fields
+// that parsing fills, except Raw which is checked separately.
+type goldenToken struct {
+	Surface       string         `json:"surface"`
+	Kind          string         `json:"kind"`
+	Reading       string         `json:"reading,omitempty"`
+	Kana          string         `json:"kana,omitempty"`
+	Romaji        string         `json:"romaji,omitempty"`
+	Score         int            `json:"score,omitempty"`
+	Seq           int            `json:"seq,omitempty"`
+	Gloss         []Gloss        `json:"gloss,omitempty"`
+	Conj          []Conj         `json:"conj,omitempty"`
+	KanjiReadings []KanjiReading `json:"kanji_readings,omitempty"`
+	Compound      []string       `json:"compound,omitempty"`
+	Components    []goldenToken  `json:"components,omitempty"`
+	Alternative   []goldenToken  `json:"alternative,omitempty"`
+}
+
+func newGoldenToken(token *JSONToken) goldenToken {
+	golden := goldenToken{
+		Surface:       token.Surface,
+		Kind:          token.Kind.String(),
+		Reading:       token.Reading,
+		Kana:          token.Kana,
+		Romaji:        token.Romaji,
+		Score:         token.Score,
+		Seq:           token.Seq,
+		Gloss:         token.Gloss,
+		Conj:          token.Conj,
+		KanjiReadings: token.KanjiReadings,
+		Compound:      token.Compound,
+	}
+	for i := range token.Components {
+		golden.Components = append(golden.Components, newGoldenToken(&token.Components[i]))
+	}
+	for i := range token.Alternative {
+		golden.Alternative = append(golden.Alternative, newGoldenToken(&token.Alternative[i]))
+	}
+	return golden
+}
+
+// TestAnalysisGolden parses the recorded outputs of ichiran found in
+// testdata/analysis and compares the tokens with the golden files next to them.
+// Run with -update to write the golden files after a deliberate change.
+func TestAnalysisGolden(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "analysis", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			output, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			tokens, err := parseAnalysis(output)
+			require.NoError(t, err)
+
+			var golden []goldenToken
+			for _, token := range *tokens {
+				golden = append(golden, newGoldenToken(token))
+				if token.Kind == TokenWord {
+					assert.True(t, json.Valid(token.Raw), "raw JSON of %q", token.Surface)
+				}
+			}
+			actual, err := json.MarshalIndent(golden, "", "  ")
+			require.NoError(t, err)
+			actual = append(actual, '\n')
+
+			goldenPath := strings.TrimSuffix(path, ".json") + ".golden"
+			if *update {
+				require.NoError(t, os.WriteFile(goldenPath, actual, 0644))
+			}
+			expected, err := os.ReadFile(goldenPath)
+			require.NoError(t, err, "run the test with -update to create the golden file")
+			assert.Equal(t, string(expected), string(actual))
+		})
+	}
+}
+
+func TestParseAnalysisRaw(t *testing.T) {
+	tokens, err := parseAnalysis([]byte(konnichihaJSON))
+	require.NoError(t, err)
+
+	var word map[string]interface{}
+	require.NoError(t, json.Unmarshal((*tokens)[0].Raw, &word))
+	assert.Equal(t, "こんにちは", word["text"])
+	assert.Equal(t, float64(1289400), word["seq"])
+}
+
+func TestParseAnalysisErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		errMsg string
+	}{
+		{
+			name:   "not an array",
+			output: `{"text":"こんにちは"}`,
+			errMsg: "expected an array of fragments",
+		},
+		{
+			name:   "unexpected fragment",
+			output: `["ok", 42]`,
+			errMsg: "fragment 1: expected a string or an array of segmentations, got 42",
+		},
+		{
+			name:   "segmentation without score",
+			output: `[[[[["konnichiha",{"text":"こんにちは"}]]]]]`,
+			errMsg: "fragment 0: segmentation 0: expected [[word entries...], score]",
+		},
+		{
+			name:   "word entry without word",
+			output: `[[[[["konnichiha"]],550]]]`,
+			errMsg: "fragment 0: segmentation 0: word entry 0: expected [\"romaji\", {word}, ...]",
+		},
+		{
+			name:   "wrongly typed field",
+			output: `[[[[["konnichiha",{"text":"こんにちは","conj":[{"readok":"yes"}]}]],550]]]`,
+			errMsg: `word entry 0: word {"text":"こんにちは","conj":[{"readok":"yes"}]}: field "conj.0.readok": expected bool, got JSON string`,
+		},
+		{
+			name:   "wrongly typed score",
+			output: `[[[[["konnichiha",{"text":"こんにちは","score":"high"}]],550]]]`,
+			errMsg: `expected a number, got "high"`,
+		},
+		{
+			name:   "wrongly typed component",
+			output: `[[[[["konnichiha",{"text":"こんにちは","components":[{"text":["こん"]}]}]],550]]]`,
+			errMsg: `field "text": expected string, got JSON array`,
+		},
+		{
+			name:   "no tokens",
+			output: `[]`,
+			errMsg: "could not find any tokens",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAnalysis([]byte(tt.output))
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
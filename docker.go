@@ -21,16 +21,29 @@ import (
 	"github.com/k0kubun/pp"
 	"github.com/rs/zerolog"
 
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/flags"
+	"github.com/docker/compose/v5/pkg/api"
+	"github.com/docker/compose/v5/pkg/compose"
+	"github.com/docker/docker/client"
 	"github.com/tassa-yoniso-manasi-karoto/dockerutil"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
-	projectName   = "ichiran"
-	containerName = "ichiran-main-1"
-
-	// GHCR images for pre-built ichiran containers
-	ghcrImageMain = "ghcr.io/tassa-yoniso-manasi-karoto/langkit-ichiran-main:latest"
-	ghcrImagePg   = "ghcr.io/tassa-yoniso-manasi-karoto/langkit-ichiran-pg:latest"
+	// Default project name, see WithProjectName
+	projectName = "ichiran"
+
+	// GHCR repositories and images for pre-built ichiran containers
+	ghcrRepoMain  = "ghcr.io/tassa-yoniso-manasi-karoto/langkit-ichiran-main"
+	ghcrRepoPg    = "ghcr.io/tassa-yoniso-manasi-karoto/langkit-ichiran-pg"
+	ghcrImageMain = ghcrRepoMain + ":" + DefaultRelease
+	ghcrImagePg   = ghcrRepoPg + ":" + DefaultRelease
+
+	// Mount point of the pgdata directory of the data dir in the pg container,
+	// and location of the database cluster beneath it
+	pgdataMount = "/var/lib/postgresql/data"
+	pgdataPath  = pgdataMount + "/pgdata"
 )
 
 var (
@@ -41,7 +54,6 @@ var (
 	reMultipleSpacesSeq = regexp.MustCompile(`\s{2,}`)
 	Logger              = zerolog.Nop()
 	// Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.TimeOnly}).With().Timestamp().Logger()
-	errNoJSONFound = fmt.Errorf("no valid JSON line found in output")
 	
 	// IchiranProgressMilestones defines progress checkpoints for first-time initialization
 	// Progress -1 is a special marker for dynamic checkpoint progress
@@ -55,13 +67,142 @@ var (
 
 // IchiranManager handles Docker lifecycle for the Ichiran project
 type IchiranManager struct {
-	docker                   *dockerutil.DockerManager
+	docker                   composeStack
 	logger                   *dockerutil.ContainerLogConsumer
 	projectName              string
 	containerName            string
+	customDataDir            string
+	mainImage                string
+	pgImage                  string
+	pinnedMainImage          string // see runningImages
+	pinnedPgImage            string
+	imagesSet                bool      // Whether WithImages or WithRelease chose the images
+	imported                 imageRefs // Images of the bundle imported into the data dir, see offline
+	postgresPassword         string
+	generatePassword         bool
 	QueryTimeout             time.Duration
 	progressHandler          dockerutil.ProgressHandler
 	downloadProgressCallback func(current, total int64, status string)
+	persistentSession        bool
+	sessionMaxRestarts       int
+	session                  *lispSession
+	nativeCommand            string
+	recordDir                string
+	replayDir                string
+	cache                    *diskCache
+	memory                   *memoryCache
+	limiter                  *limiter
+	recovery                 *RecoveryPolicy
+	recoverySem              chan struct{}       // see lockRecovery
+	stackSem                 *semaphore.Weighted // Taken by queries, all of it by withoutRecovery
+	versionMu                sync.Mutex
+	version                  string // see backendVersion
+}
+
+// composeStack runs the compose project of a manager, see dockerutil.DockerManager
+type composeStack interface {
+	Init() error
+	InitQuiet() error
+	InitRecreate() error
+	InitRecreateNoCache() error
+	Stop() error
+	Down() error
+	Close() error
+	Status() (string, error)
+	GetClient() (*client.Client, error)
+}
+
+// newComposeStack creates the stack running the compose project of cfg, an
+// offlineStack if its images must never be pulled
+var newComposeStack = func(ctx context.Context, cfg dockerutil.Config) (composeStack, error) {
+	dockerManager, err := dockerutil.NewDockerManager(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range cfg.Project.Services {
+		if service.PullPolicy == types.PullPolicyNever {
+			return newOfflineStack(ctx, cfg, dockerManager)
+		}
+	}
+	return dockerManager, nil
+}
+
+// offlineStack runs a compose project whose images are only available locally,
+// e.g. loaded from a bundle. dockerutil.DockerManager pulls the images, which
+// queries the registry, before bringing the project up: offlineStack brings it
+// up without pulling anything.
+type offlineStack struct {
+	*dockerutil.DockerManager
+	ctx     context.Context
+	service api.Compose
+	cfg     dockerutil.Config
+}
+
+func newOfflineStack(ctx context.Context, cfg dockerutil.Config, dockerManager *dockerutil.DockerManager) (*offlineStack, error) {
+	cli, err := command.NewDockerCli()
+	if err != nil {
+		return nil, fmt.Errorf("failed to spawn Docker CLI: %w", err)
+	}
+	if err := cli.Initialize(flags.NewClientOptions()); err != nil {
+		return nil, fmt.Errorf("failed to initialize Docker CLI: %w", err)
+	}
+	service, err := compose.NewComposeService(cli)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Compose service: %w", err)
+	}
+	return &offlineStack{DockerManager: dockerManager, ctx: ctx, service: service, cfg: cfg}, nil
+}
+
+func (s *offlineStack) Init() error                { return s.up(false) }
+func (s *offlineStack) InitQuiet() error           { return s.up(false) }
+func (s *offlineStack) InitRecreate() error        { return s.up(true) }
+func (s *offlineStack) InitRecreateNoCache() error { return s.up(true) }
+
+// up creates the containers, all of them again if recreate is true, starts them
+// and waits for ichiran to be ready. Like dockerutil, it leaves a running
+// project as is unless recreate is true.
+func (s *offlineStack) up(recreate bool) error {
+	if !recreate {
+		if status, err := s.Status(); err == nil && status == api.RUNNING {
+			return nil
+		}
+	}
+	strategy, timeout := api.RecreateNever, s.cfg.Timeout.Create
+	if recreate {
+		strategy, timeout = api.RecreateForce, s.cfg.Timeout.Recreate
+	}
+	services := s.cfg.Project.ServiceNames()
+
+	upDone := make(chan error, 1)
+	go func() {
+		upDone <- s.service.Up(s.ctx, s.cfg.Project, api.UpOptions{
+			Create: api.CreateOptions{
+				Services:      services,
+				RemoveOrphans: true,
+				Recreate:      strategy,
+				Timeout:       &timeout,
+			},
+			Start: api.StartOptions{
+				Project:     s.cfg.Project,
+				Services:    services,
+				Attach:      s.cfg.LogConsumer,
+				Wait:        true,
+				WaitTimeout: s.cfg.Timeout.Start,
+			},
+		})
+	}()
+	select {
+	case <-s.cfg.LogConsumer.GetInitChan():
+	case err := <-upDone:
+		if err != nil {
+			return fmt.Errorf("container startup failed: %w", err)
+		}
+	case <-time.After(timeout + s.cfg.Timeout.Start):
+		return fmt.Errorf("timeout waiting for containers to start")
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	return nil
 }
 
 // ManagerOption defines function signature for options to configure IchiranManager
@@ -74,22 +215,46 @@ func WithQueryTimeout(timeout time.Duration) ManagerOption {
 	}
 }
 
-// WithProjectName sets a custom project name for multiple instances
+// WithProjectName sets a custom project name for multiple instances. The
+// compose project, its network, its data directory and the names of its
+// containers are all derived from it.
 func WithProjectName(name string) ManagerOption {
 	return func(im *IchiranManager) {
 		im.projectName = name
-		// Default container name is derived from project name
-		im.containerName = name + "-main-1"
 	}
 }
 
-// WithContainerName overrides the default container name
+// WithContainerName overrides the name of the main container, "<project>-main-1" by default
 func WithContainerName(name string) ManagerOption {
 	return func(im *IchiranManager) {
 		im.containerName = name
 	}
 }
 
+// WithDataDir sets the directory holding the data of the project (pgdata,
+// secrets, cache), xdg.ConfigHome/<project> by default
+func WithDataDir(dir string) ManagerOption {
+	return func(im *IchiranManager) {
+		im.customDataDir = dir
+	}
+}
+
+// WithImages sets the images of the main and pg containers, for instance to pin
+// them by digest ("registry.example.com/ichiran-main@sha256:...") or to pull
+// them from a private registry. An empty reference keeps the default image.
+func WithImages(main, pg string) ManagerOption {
+	return func(im *IchiranManager) {
+		if main != "" {
+			im.mainImage = main
+			im.imagesSet = true
+		}
+		if pg != "" {
+			im.pgImage = pg
+			im.imagesSet = true
+		}
+	}
+}
+
 // WithProgressHandler sets a progress handler for tracking initialization
 func WithProgressHandler(handler dockerutil.ProgressHandler) ManagerOption {
 	return func(im *IchiranManager) {
@@ -104,22 +269,45 @@ func WithDownloadProgressCallback(cb func(current, total int64, status string))
 	}
 }
 
+// WithPersistentSession makes Analyze talk to a long-lived ichiran-cli process
+// inside the main container instead of spawning a new one for every query.
+// The session is started lazily by the first query and restarted if it crashes.
+func WithPersistentSession() ManagerOption {
+	return func(im *IchiranManager) {
+		im.persistentSession = true
+	}
+}
+
+// WithSessionMaxRestarts sets how many times a crashed persistent session is
+// restarted while serving a single query (see DefaultSessionMaxRestarts)
+func WithSessionMaxRestarts(n int) ManagerOption {
+	return func(im *IchiranManager) {
+		im.sessionMaxRestarts = n
+	}
+}
+
 // ptr returns a pointer to the given string value
 func ptr(s string) *string {
 	return &s
 }
 
 // buildComposeProject creates the compose project definition for ichiran
-func buildComposeProject(dataDir string) *types.Project {
+func (im *IchiranManager) buildComposeProject(dataDir string) *types.Project {
 	// Ensure pgdata directory exists
 	pgdataDir := filepath.Join(dataDir, "pgdata")
 	os.MkdirAll(pgdataDir, 0755)
 
 	// Network name follows Docker Compose convention: {project}_{network}
-	defaultNetworkName := projectName + "_default"
+	defaultNetworkName := im.projectName + "_default"
+	mainImage, pgImage := im.runningImages()
+	// The images of an imported bundle can't be pulled
+	var pullPolicy string
+	if im.offline() {
+		pullPolicy = types.PullPolicyNever
+	}
 
 	return &types.Project{
-		Name: projectName,
+		Name: im.projectName,
 		// Default network for service communication
 		Networks: types.Networks{
 			"default": types.NetworkConfig{
@@ -128,17 +316,19 @@ func buildComposeProject(dataDir string) *types.Project {
 		},
 		Services: types.Services{
 			"pg": {
-				Name:    "pg",
-				Image:   ghcrImagePg,
-				ShmSize: types.UnitBytes(1024 * 1024 * 1024), // 1GB
+				Name:          "pg",
+				ContainerName: im.pgContainerName(),
+				Image:         pgImage,
+				PullPolicy:    pullPolicy,
+				ShmSize:       types.UnitBytes(1024 * 1024 * 1024), // 1GB
 				Environment: types.MappingWithEquals{
-					"POSTGRES_PASSWORD": ptr("password"),
-					"PGDATA":            ptr("/var/lib/postgresql/data/pgdata"),
+					"POSTGRES_PASSWORD": ptr(im.postgresPassword),
+					"PGDATA":            ptr(pgdataPath),
 				},
 				Volumes: []types.ServiceVolumeConfig{{
 					Type:   types.VolumeTypeBind,
 					Source: pgdataDir,
-					Target: "/var/lib/postgresql/data",
+					Target: pgdataMount,
 				}},
 				// Attach to default network
 				Networks: map[string]*types.ServiceNetworkConfig{
@@ -146,8 +336,13 @@ func buildComposeProject(dataDir string) *types.Project {
 				},
 			},
 			"main": {
-				Name:  "main",
-				Image: ghcrImageMain,
+				Name:          "main",
+				ContainerName: im.containerName,
+				Image:         mainImage,
+				PullPolicy:    pullPolicy,
+				Environment: types.MappingWithEquals{
+					"POSTGRES_PASSWORD": ptr(im.postgresPassword),
+				},
 				// Attach to default network (can reach pg via hostname "pg")
 				Networks: map[string]*types.ServiceNetworkConfig{
 					"default": nil,
@@ -159,28 +354,45 @@ func buildComposeProject(dataDir string) *types.Project {
 
 // NewManager creates a new Ichiran manager instance
 func NewManager(ctx context.Context, opts ...ManagerOption) (*IchiranManager, error) {
-	manager := &IchiranManager{
-		projectName:   projectName,
-		containerName: containerName,
-		QueryTimeout:  DefaultQueryTimeout,
+	manager := newIchiranManager(opts...)
+
+	// The native backend and the replay mode need neither Docker nor a data directory
+	if !manager.usesDocker() {
+		if manager.persistentSession {
+			return nil, fmt.Errorf("persistent session is only supported by the Docker backend")
+		}
+		return manager, nil
 	}
 
-	// Apply options
-	for _, opt := range opts {
-		opt(manager)
+	if manager.persistentSession {
+		manager.session = newLispSession(manager, manager.sessionMaxRestarts)
 	}
 
-	// Get XDG data directory for ichiran
-	dataDir := filepath.Join(xdg.ConfigHome, manager.projectName)
+	dataDir := manager.dataDir()
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
+	if err := manager.loadImportedImages(); err != nil {
+		return nil, err
+	}
+	if err := manager.resolvePostgresPassword(); err != nil {
+		return nil, err
+	}
 
-	// Build compose project
-	project := buildComposeProject(dataDir)
+	if err := manager.newDockerManager(ctx, dataDir); err != nil {
+		return nil, err
+	}
+
+	return manager, nil
+}
+
+// newDockerManager sets up the compose project of the manager, with its
+// current images, and the Docker manager running it
+func (im *IchiranManager) newDockerManager(ctx context.Context, dataDir string) error {
+	project := im.buildComposeProject(dataDir)
 
 	logConfig := dockerutil.LogConfig{
-		Prefix:      manager.projectName,
+		Prefix:      im.projectName,
 		ShowService: true,
 		ShowType:    true,
 		LogLevel:    DefaultDockerLogLevel,
@@ -190,13 +402,13 @@ func NewManager(ctx context.Context, opts ...ManagerOption) (*IchiranManager, er
 	logger := dockerutil.NewContainerLogConsumer(logConfig)
 
 	// Set up progress tracking if handler provided
-	if manager.progressHandler != nil {
-		logger.ProgressHandler = manager.progressHandler
+	if im.progressHandler != nil {
+		logger.ProgressHandler = im.progressHandler
 		logger.Milestones = IchiranProgressMilestones
 	}
 
 	cfg := dockerutil.Config{
-		ProjectName:      manager.projectName,
+		ProjectName:      im.projectName,
 		Project:          project,
 		RequiredServices: []string{"main", "pg"},
 		LogConsumer:      logger,
@@ -205,23 +417,70 @@ func NewManager(ctx context.Context, opts ...ManagerOption) (*IchiranManager, er
 			Recreate: 25 * time.Minute,
 			Start:    60 * time.Second,
 		},
-		OnPullProgress: manager.downloadProgressCallback,
+		OnPullProgress: im.downloadProgressCallback,
 	}
 
-	dockerManager, err := dockerutil.NewDockerManager(ctx, cfg)
+	stack, err := newComposeStack(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Docker manager: %w", err)
+		return fmt.Errorf("failed to create Docker manager: %w", err)
 	}
 
-	manager.docker = dockerManager
-	manager.logger = logger
+	im.docker = stack
+	im.logger = logger
+	return nil
+}
 
-	return manager, nil
+// newIchiranManager applies opts to a manager with the default settings and
+// derives from its project name whatever the options left unset
+func newIchiranManager(opts ...ManagerOption) *IchiranManager {
+	manager := &IchiranManager{
+		projectName:        projectName,
+		mainImage:          ghcrImageMain,
+		pgImage:            ghcrImagePg,
+		QueryTimeout:       DefaultQueryTimeout,
+		sessionMaxRestarts: DefaultSessionMaxRestarts,
+		recoverySem:        make(chan struct{}, 1),
+		stackSem:           semaphore.NewWeighted(maintenanceWeight),
+	}
+
+	// Apply options
+	for _, opt := range opts {
+		opt(manager)
+	}
+	if manager.containerName == "" {
+		manager.containerName = manager.projectName + "-main-1"
+	}
+	if manager.cache != nil && manager.cache.dir == "" {
+		manager.cache.dir = filepath.Join(manager.dataDir(), "cache")
+	}
+	return manager
+}
+
+// dataDir returns the directory holding the data of the project
+func (im *IchiranManager) dataDir() string {
+	if im.customDataDir != "" {
+		return im.customDataDir
+	}
+	return filepath.Join(xdg.ConfigHome, im.projectName)
+}
+
+// runningImages returns the images the containers are created from: the
+// configured ones, unless a failed Upgrade pinned the previous ones
+func (im *IchiranManager) runningImages() (main, pg string) {
+	if im.pinnedMainImage != "" {
+		return im.pinnedMainImage, im.pinnedPgImage
+	}
+	return im.mainImage, im.pgImage
 }
 
-// PullImages pre-pulls the GHCR images with progress tracking
+// PullImages pre-pulls the images of the containers with progress tracking.
+// The images of an imported bundle are local and never pulled.
 func (im *IchiranManager) PullImages(ctx context.Context) error {
-	images := []string{ghcrImagePg, ghcrImageMain}
+	if !im.usesDocker() || im.offline() {
+		return nil
+	}
+	mainImage, pgImage := im.runningImages()
+	images := []string{pgImage, mainImage}
 
 	opts := dockerutil.DefaultPullOptions()
 	if im.downloadProgressCallback != nil {
@@ -234,16 +493,28 @@ func (im *IchiranManager) PullImages(ctx context.Context) error {
 
 // Init initializes the docker service (pulls images and starts containers)
 func (im *IchiranManager) Init(ctx context.Context) error {
+	if !im.usesDocker() {
+		return im.checkBackend()
+	}
+	im.resetBackendVersion()
 	return im.docker.Init()
 }
 
 // InitQuiet initializes the docker service with reduced logging
 func (im *IchiranManager) InitQuiet(ctx context.Context) error {
+	if !im.usesDocker() {
+		return im.checkBackend()
+	}
+	im.resetBackendVersion()
 	return im.docker.InitQuiet()
 }
 
 // InitRecreate remove existing containers then builds and up the containers
 func (im *IchiranManager) InitRecreate(ctx context.Context, noCache bool) error {
+	if !im.usesDocker() {
+		return im.checkBackend()
+	}
+	im.resetBackendVersion()
 	if noCache {
 		return im.docker.InitRecreateNoCache()
 	}
@@ -259,17 +530,56 @@ func (im *IchiranManager) MustInit(ctx context.Context) {
 
 // Stop stops the docker service
 func (im *IchiranManager) Stop(ctx context.Context) error {
+	im.closeSession()
+	if !im.usesDocker() {
+		return nil
+	}
 	return im.docker.Stop()
 }
 
 // Close implements io.Closer
 func (im *IchiranManager) Close() error {
+	im.closeSession()
+	if !im.usesDocker() {
+		return nil
+	}
 	im.logger.Close()
 	return im.docker.Close()
 }
 
-// Status returns the current status of the project
+// usesDocker reports whether queries are served by the containers, as opposed
+// to the native backend or to replayed recordings
+func (im *IchiranManager) usesDocker() bool {
+	return !im.isNative() && im.replayDir == ""
+}
+
+// checkBackend makes sure that a manager that doesn't use Docker can serve queries
+func (im *IchiranManager) checkBackend() error {
+	if im.replayDir != "" {
+		if _, err := os.Stat(im.replayDir); err != nil {
+			return fmt.Errorf("failed to access recordings: %w", err)
+		}
+		return nil
+	}
+	return im.checkNativeCommand()
+}
+
+// closeSession terminates the persistent session, if any
+func (im *IchiranManager) closeSession() {
+	if im.session != nil {
+		im.session.Close()
+	}
+}
+
+// Status returns the current status of the project, "native" for the native
+// backend and "replay" in replay mode
 func (im *IchiranManager) Status(ctx context.Context) (string, error) {
+	switch {
+	case im.isNative():
+		return "native", nil
+	case im.replayDir != "":
+		return "replay", nil
+	}
 	return im.docker.Status()
 }
 
@@ -278,6 +588,11 @@ func (im *IchiranManager) GetContainerName() string {
 	return im.containerName
 }
 
+// pgContainerName returns the name of the Postgres container
+func (im *IchiranManager) pgContainerName() string {
+	return im.projectName + "-pg-1"
+}
+
 // For backward compatibility with existing code
 var (
 	instance *IchiranManager
@@ -370,6 +685,7 @@ func Close() error {
 	defer mu.Unlock()
 	
 	if instance != nil {
+		instance.closeSession()
 		instance.logger.Close()
 		err := instance.docker.Close()
 		// Mark the instance as closed
@@ -397,8 +713,9 @@ func getOrCreateDefaultManager(ctx context.Context) (*IchiranManager, error) {
 	return instance, nil
 }
 
-// readDockerOutput reads and processes multiplexed output from Docker.
-func readDockerOutput(ctx context.Context, reader io.Reader) ([]byte, error) {
+// readDockerOutput reads and processes multiplexed output from Docker. What the
+// process printed on stderr is also copied to stderr, if not nil.
+func readDockerOutput(ctx context.Context, reader io.Reader, stderr io.Writer) ([]byte, error) {
 	var output bytes.Buffer
 	header := make([]byte, 8)
 	for {
@@ -429,14 +746,17 @@ func readDockerOutput(ctx context.Context, reader io.Reader) ([]byte, error) {
 		}
 		// Append to output buffer
 		output.Write(payload)
+		if header[0] == 2 && stderr != nil {
+			stderr.Write(payload)
+		}
 	}
 	return bytes.TrimSpace(output.Bytes()), nil
 }
 
 // extractJSONFromDockerOutput combines reading Docker output and extracting JSON
-func extractJSONFromDockerOutput(ctx context.Context, reader io.Reader) ([]byte, error) {
+func extractJSONFromDockerOutput(ctx context.Context, reader io.Reader, stderr io.Writer) ([]byte, error) {
 	// First, read the Docker multiplexed output.
-	rawOutput, err := readDockerOutput(ctx, reader)
+	rawOutput, err := readDockerOutput(ctx, reader, stderr)
 	if err != nil {
 		return nil, fmt.Errorf("error reading docker output: %w", err)
 	}
@@ -445,14 +765,24 @@ func extractJSONFromDockerOutput(ctx context.Context, reader io.Reader) ([]byte,
 	//color.Redln("RAW ICHIRAN-CLI OUTPUT:")
 	//fmt.Println(string(rawOutput))
 	if strings.Contains(string(rawOutput), "ichiran-cli: command not found") {
-		return []byte{}, fmt.Errorf("\"%s\": "+
-			"this error is associated with a temporary failure in " +
-			"domain resolution during container creation, "+
-			"check your network, disable any VPN and restart %s.",
-			rawOutput, dockerutil.DockerBackendName())
+		return []byte{}, dnsFailureError(rawOutput)
 	}
-	
 
+	return extractJSON(ctx, rawOutput)
+}
+
+// dnsFailureError explains the cryptic "command not found" that ichiran-cli
+// outputs when the container couldn't resolve domains while it was created.
+func dnsFailureError(rawOutput []byte) error {
+	return fmt.Errorf("%w: \"%s\": "+
+		"this error is associated with a temporary failure in " +
+		"domain resolution during container creation, "+
+		"check your network, disable any VPN and restart %s.",
+		ErrCommandNotFound, rawOutput, dockerutil.DockerBackendName())
+}
+
+// extractJSON returns the first line of the ichiran-cli output that holds valid JSON
+func extractJSON(ctx context.Context, rawOutput []byte) ([]byte, error) {
 	// Use bufio.Reader so we can read arbitrarily long lines.
 	r := bufio.NewReader(bytes.NewReader(rawOutput))
 	for {
@@ -497,14 +827,14 @@ func extractJSONFromDockerOutput(ctx context.Context, reader io.Reader) ([]byte,
 		}
 	}
 
-	// Check context one more time before returning errNoJSONFound
+	// Check context one more time before returning ErrNoJSON
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
 	}
 
-	return nil, errNoJSONFound
+	return nil, ErrNoJSON
 }
 
 func placeholder3456543() {
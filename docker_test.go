@@ -0,0 +1,501 @@
+package ichiran
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/compose-spec/compose-go/v2/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tassa-yoniso-manasi-karoto/dockerutil"
+)
+
+// composeNames returns every name a compose project claims on the host
+func composeNames(project *types.Project) []string {
+	names := []string{project.Name}
+	for _, network := range project.Networks {
+		names = append(names, network.Name)
+	}
+	for _, service := range project.Services {
+		names = append(names, service.ContainerName)
+		for _, volume := range service.Volumes {
+			names = append(names, volume.Source)
+		}
+	}
+	return names
+}
+
+func TestComposeProjectNames(t *testing.T) {
+	defaultManager := newIchiranManager()
+	assert.Equal(t, "ichiran", defaultManager.projectName)
+	assert.Equal(t, "ichiran-main-1", defaultManager.containerName)
+	assert.Equal(t, "ichiran-pg-1", defaultManager.pgContainerName())
+
+	other := newIchiranManager(WithProjectName("other"))
+	assert.Equal(t, "other-main-1", other.GetContainerName())
+	assert.Equal(t, "other", filepath.Base(other.dataDir()))
+
+	first := defaultManager.buildComposeProject(filepath.Join(t.TempDir(), defaultManager.projectName))
+	second := other.buildComposeProject(filepath.Join(t.TempDir(), other.projectName))
+	assert.Equal(t, "other", second.Name)
+	assert.Equal(t, "other_default", second.Networks["default"].Name)
+	assert.Equal(t, "other-main-1", second.Services["main"].ContainerName)
+
+	firstNames := composeNames(first)
+	for _, name := range composeNames(second) {
+		assert.NotEmpty(t, name)
+		assert.NotContains(t, firstNames, name)
+	}
+
+	t.Run("explicit container name", func(t *testing.T) {
+		for _, opts := range [][]ManagerOption{
+			{WithContainerName("custom"), WithProjectName("other")},
+			{WithProjectName("other"), WithContainerName("custom")},
+		} {
+			im := newIchiranManager(opts...)
+			assert.Equal(t, "custom", im.containerName)
+			assert.Equal(t, "custom", im.buildComposeProject(t.TempDir()).Services["main"].ContainerName)
+		}
+	})
+}
+
+func TestComposeProjectOptions(t *testing.T) {
+	dir := t.TempDir()
+	mainImage := "registry.example.com/ichiran-main@sha256:" + strings.Repeat("a", 64)
+	im := newIchiranManager(WithDataDir(dir), WithImages(mainImage, ""), WithCache("", 0))
+	assert.Equal(t, dir, im.dataDir())
+	assert.Equal(t, filepath.Join(dir, "cache"), im.cache.dir)
+
+	project := im.buildComposeProject(im.dataDir())
+	assert.Equal(t, mainImage, project.Services["main"].Image)
+	assert.Equal(t, ghcrImagePg, project.Services["pg"].Image, "empty references keep the default")
+	assert.Equal(t, filepath.Join(dir, "pgdata"), project.Services["pg"].Volumes[0].Source)
+	assert.DirExists(t, filepath.Join(dir, "pgdata"))
+}
+
+// fakeContainer is a container of fakeDocker
+type fakeContainer struct {
+	running bool
+	image   string // Reference the container was created from
+	imageID string
+}
+
+// fakeExec is an exec created in fakeDocker
+type fakeExec struct {
+	container string
+	options   container.ExecOptions
+	exitCode  int
+}
+
+// fakeDocker fakes both the compose stack of a manager and the Docker Engine
+// API its client talks to. What is done to them is recorded in events.
+type fakeDocker struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	events     []string
+	project    *types.Project
+	containers map[string]*fakeContainer // By name
+	images     map[string]string         // Local image IDs by reference
+	digests    map[string][]string       // Repository digests by image ID
+	remote     map[string]string         // Image IDs pulled by reference
+	loads      []string                  // Image IDs loads make available
+	execs      []*fakeExec
+
+	// noNetwork makes pulls fail, and with them bringing up a project whose
+	// images may be pulled, as dockerutil pulls them first
+	noNetwork bool
+
+	// run answers the execs with the standard output and the exit code of cmd
+	// run in the container name, fed with stdin. Nothing and 0 if nil.
+	run func(name string, cmd []string, stdin string) (string, int)
+	// attach, if not nil, is called when an exec is started, which fails with
+	// the error it returns
+	attach func(exec *fakeExec) error
+}
+
+// newFakeDocker makes im run its containers in a new fakeDocker
+func newFakeDocker(t *testing.T, im *IchiranManager) *fakeDocker {
+	f := &fakeDocker{
+		t:          t,
+		containers: make(map[string]*fakeContainer),
+		images:     make(map[string]string),
+		digests:    make(map[string][]string),
+		remote:     make(map[string]string),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+
+	saved := newComposeStack
+	newComposeStack = func(ctx context.Context, cfg dockerutil.Config) (composeStack, error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.project = cfg.Project
+		f.events = append(f.events, "configure "+cfg.Project.Services["main"].Image+" "+cfg.Project.Services["pg"].Image)
+		return f, nil
+	}
+	t.Cleanup(func() { newComposeStack = saved })
+	require.NoError(t, im.newDockerManager(context.Background(), im.dataDir()))
+	f.events = nil
+	return f
+}
+
+// takeEvents returns the events recorded so far and forgets them
+func (f *fakeDocker) takeEvents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events := f.events
+	f.events = nil
+	return events
+}
+
+// container returns a copy of the container name, zero if it doesn't exist
+func (f *fakeDocker) container(name string) fakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.containers[name]; ok {
+		return *c
+	}
+	return fakeContainer{}
+}
+
+func (f *fakeDocker) record(format string, args ...any) {
+	f.events = append(f.events, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeDocker) Init() error                { return f.up("init", false) }
+func (f *fakeDocker) InitQuiet() error           { return f.up("init", false) }
+func (f *fakeDocker) InitRecreate() error        { return f.up("recreate", true) }
+func (f *fakeDocker) InitRecreateNoCache() error { return f.up("recreate", true) }
+
+// up creates the missing containers of the project, all of them if recreate
+// is true, and starts them. Like dockerutil, it leaves a project that is still
+// partly running as is unless recreate is true.
+func (f *fakeDocker) up(event string, recreate bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("%s", event)
+	if f.noNetwork {
+		for _, service := range f.project.Services {
+			if service.PullPolicy != types.PullPolicyNever {
+				return fmt.Errorf("failed to pull images: network is unreachable")
+			}
+		}
+	}
+	if !recreate {
+		for _, c := range f.containers {
+			if c.running {
+				return nil
+			}
+		}
+	}
+	for _, service := range f.project.Services {
+		c, ok := f.containers[service.ContainerName]
+		if !ok || recreate {
+			id, ok := f.images[service.Image]
+			if !ok {
+				return fmt.Errorf("no such image: %s", service.Image)
+			}
+			c = &fakeContainer{image: service.Image, imageID: id}
+			f.containers[service.ContainerName] = c
+		}
+		c.running = true
+	}
+	return nil
+}
+
+func (f *fakeDocker) Stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("stop")
+	for _, c := range f.containers {
+		c.running = false
+	}
+	return nil
+}
+
+func (f *fakeDocker) Down() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("down")
+	clear(f.containers)
+	return nil
+}
+
+func (f *fakeDocker) Close() error { return f.Stop() }
+
+func (f *fakeDocker) Status() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.containers {
+		if !c.running {
+			return "exited", nil
+		}
+	}
+	return "running", nil
+}
+
+func (f *fakeDocker) GetClient() (*client.Client, error) {
+	return client.NewClientWithOpts(client.WithHost("tcp://"+f.server.Listener.Addr().String()), client.WithVersion("1.51"))
+}
+
+var reAPIVersion = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// serve answers the requests of the Docker client
+func (f *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	path := reAPIVersion.ReplaceAllString(r.URL.Path, "/")
+	// cut returns what lies between prefix and suffix in path
+	cut := func(method, prefix, suffix string) (string, bool) {
+		if r.Method != method || !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+			return "", false
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix), true
+	}
+
+	if path == "/images/create" && r.Method == http.MethodPost {
+		f.pull(w, r)
+		return
+	}
+	if path == "/images/load" && r.Method == http.MethodPost {
+		f.load(w, r)
+		return
+	}
+	if name, ok := cut(http.MethodGet, "/containers/", "/json"); ok {
+		f.inspectContainer(w, name)
+		return
+	}
+	if name, ok := cut(http.MethodPost, "/containers/", "/start"); ok {
+		f.setRunning(w, name, true)
+		return
+	}
+	if name, ok := cut(http.MethodPost, "/containers/", "/stop"); ok {
+		f.setRunning(w, name, false)
+		return
+	}
+	if name, ok := cut(http.MethodPost, "/containers/", "/exec"); ok {
+		f.createExec(w, r, name)
+		return
+	}
+	if id, ok := cut(http.MethodPost, "/exec/", "/start"); ok {
+		f.startExec(w, r, id)
+		return
+	}
+	if id, ok := cut(http.MethodGet, "/exec/", "/json"); ok {
+		f.inspectExec(w, id)
+		return
+	}
+	if name, ok := cut(http.MethodGet, "/images/", "/json"); ok {
+		f.inspectImage(w, name)
+		return
+	}
+	if id, ok := cut(http.MethodPost, "/images/", "/tag"); ok {
+		f.tagImage(w, r, id)
+		return
+	}
+	f.t.Errorf("unexpected Docker API request: %s %s", r.Method, r.URL.Path)
+	apiError(w, http.StatusNotImplemented, "not implemented")
+}
+
+// apiError answers with an error of the Docker API
+func apiError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeDocker) inspectContainer(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[name]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such container: "+name)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"Id":     name,
+		"Image":  c.imageID,
+		"State":  map[string]any{"Running": c.running},
+		"Config": map[string]any{"Image": c.image, "User": ""},
+	})
+}
+
+func (f *fakeDocker) setRunning(w http.ResponseWriter, name string, running bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[name]
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such container: "+name)
+		return
+	}
+	if running {
+		f.record("start %s", name)
+	} else {
+		f.record("stop %s", name)
+	}
+	c.running = running
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// imageID returns the ID of the local image name, a reference or an ID
+func (f *fakeDocker) imageID(name string) (string, bool) {
+	if id, ok := f.images[name]; ok {
+		return id, true
+	}
+	for _, id := range f.images {
+		if id == name {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (f *fakeDocker) inspectImage(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, ok := f.imageID(name)
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such image: "+name)
+		return
+	}
+	writeJSON(w, map[string]any{"Id": id, "RepoDigests": f.digests[id]})
+}
+
+func (f *fakeDocker) pull(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reference := r.URL.Query().Get("fromImage")
+	if tag := r.URL.Query().Get("tag"); strings.HasPrefix(tag, "sha256:") {
+		reference += "@" + tag
+	} else if tag != "" {
+		reference += ":" + tag
+	}
+	f.record("pull %s", reference)
+	id, ok := f.remote[reference]
+	if f.noNetwork {
+		writeJSON(w, map[string]any{"error": "network is unreachable", "errorDetail": map[string]any{"message": "network is unreachable"}})
+		return
+	}
+	if !ok {
+		writeJSON(w, map[string]any{"error": "manifest unknown", "errorDetail": map[string]any{"message": "manifest unknown"}})
+		return
+	}
+	f.images[reference] = id
+	writeJSON(w, map[string]any{"status": "Downloaded newer image for " + reference})
+}
+
+func (f *fakeDocker) load(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("load")
+	for _, id := range f.loads {
+		f.images[id] = id
+	}
+	writeJSON(w, map[string]any{"stream": "Loaded image"})
+}
+
+func (f *fakeDocker) tagImage(w http.ResponseWriter, r *http.Request, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reference := r.URL.Query().Get("repo") + ":" + r.URL.Query().Get("tag")
+	f.record("tag %s", reference)
+	f.images[reference] = id
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeDocker) createExec(w http.ResponseWriter, r *http.Request, name string) {
+	var options container.ExecOptions
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.containers[name]; !ok || !c.running {
+		apiError(w, http.StatusConflict, "container "+name+" is not running")
+		return
+	}
+	f.record("exec %s %s", name, options.Cmd[0])
+	f.execs = append(f.execs, &fakeExec{container: name, options: options})
+	writeJSON(w, map[string]any{"Id": fmt.Sprint(len(f.execs) - 1)})
+}
+
+// exec returns the exec id
+func (f *fakeDocker) exec(id string) (*fakeExec, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, exec := range f.execs {
+		if fmt.Sprint(i) == id {
+			return exec, true
+		}
+	}
+	return nil, false
+}
+
+// startExec runs the exec id on the hijacked connection of the request
+func (f *fakeDocker) startExec(w http.ResponseWriter, r *http.Request, id string) {
+	io.Copy(io.Discard, r.Body)
+	exec, ok := f.exec(id)
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such exec instance: "+id)
+		return
+	}
+	if f.attach != nil {
+		if err := f.attach(exec); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		f.t.Errorf("failed to hijack connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "HTTP/1.1 101 UPGRADED\r\n"+
+		"Content-Type: application/vnd.docker.multiplexed-stream\r\n"+
+		"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	var stdin []byte
+	if exec.options.AttachStdin {
+		stdin, _ = io.ReadAll(rw)
+	}
+	stdout, exitCode := "", 0
+	if f.run != nil {
+		stdout, exitCode = f.run(exec.container, exec.options.Cmd, string(stdin))
+	}
+	f.mu.Lock()
+	exec.exitCode = exitCode
+	f.mu.Unlock()
+	if stdout != "" {
+		conn.Write(muxFrame(1, stdout))
+	}
+}
+
+func (f *fakeDocker) inspectExec(w http.ResponseWriter, id string) {
+	exec, ok := f.exec(id)
+	if !ok {
+		apiError(w, http.StatusNotFound, "No such exec instance: "+id)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON(w, map[string]any{"ExitCode": exec.exitCode, "Running": false})
+}
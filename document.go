@@ -0,0 +1,206 @@
+package ichiran
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// DefaultChunkSize is the size in runes of the chunks AnalyzeDocument sends to ichiran
+	DefaultChunkSize = 200
+	// DefaultDocumentConcurrency is the number of chunks AnalyzeDocument analyzes at once
+	DefaultDocumentConcurrency = 4
+)
+
+// sentenceEnds terminate a sentence, see splitSentences
+const (
+	sentenceEnds    = "。！？!?．"
+	closingBrackets = "」』）)】〉》〕］]｝}\"'”’"
+)
+
+// DocumentOption configures AnalyzeDocument
+type DocumentOption func(*documentConfig)
+
+type documentConfig struct {
+	chunkSize   int
+	concurrency int
+	progress    func(done, total int)
+}
+
+// WithChunkSize sets the maximum size in runes of the chunks sent to ichiran.
+// Sentences are never split, so a chunk may exceed it if a single sentence does.
+func WithChunkSize(runes int) DocumentOption {
+	return func(cfg *documentConfig) {
+		cfg.chunkSize = runes
+	}
+}
+
+// WithDocumentConcurrency sets how many chunks are analyzed at once. The
+// manager may still limit the queries it runs at once, see WithMaxConcurrency.
+func WithDocumentConcurrency(n int) DocumentOption {
+	return func(cfg *documentConfig) {
+		cfg.concurrency = n
+	}
+}
+
+// WithDocumentProgress sets a function called each time a chunk was analyzed,
+// with the number of chunks analyzed so far and the total. Calls never overlap.
+func WithDocumentProgress(fn func(done, total int)) DocumentOption {
+	return func(cfg *documentConfig) {
+		cfg.progress = fn
+	}
+}
+
+// AnalyzeDocument analyzes a long text, which would be slow to analyze in a
+// single query and could hit the query timeout. The text is split into chunks of
+// whole sentences that are analyzed concurrently and whose tokens are stitched
+// back together, with offsets relative to text.
+func (im *IchiranManager) AnalyzeDocument(ctx context.Context, text string, opts ...DocumentOption) (*JSONTokens, error) {
+	cfg := documentConfig{
+		chunkSize:   DefaultChunkSize,
+		concurrency: DefaultDocumentConcurrency,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	chunks := chunkText(text, cfg.chunkSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		results  = make([]*JSONTokens, len(chunks))
+		slots    = make(chan struct{}, max(cfg.concurrency, 1))
+		wg       sync.WaitGroup
+		mu       sync.Mutex // guards the variables below
+		done     int
+		firstErr error
+	)
+	for i, chunk := range chunks {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			tokens, err := im.Analyze(ctx, chunk.text)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// Only the first error matters, the others are likely due to the cancellation
+				if firstErr == nil {
+					firstErr = fmt.Errorf("chunk %d: %w", i, err)
+					cancel()
+				}
+				return
+			}
+			results[i] = tokens
+			done++
+			if cfg.progress != nil {
+				cfg.progress(done, len(chunks))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var tokens JSONTokens
+	for i, chunk := range chunks {
+		for _, token := range *results[i] {
+			token.shift(chunk.offset, chunk.runeOffset)
+			tokens = append(tokens, token)
+		}
+	}
+	return &tokens, nil
+}
+
+// AnalyzeDocumentWithContext analyzes a long text with the default manager, see IchiranManager.AnalyzeDocument
+func AnalyzeDocumentWithContext(ctx context.Context, text string, opts ...DocumentOption) (*JSONTokens, error) {
+	mgr, err := getOrCreateDefaultManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return mgr.AnalyzeDocument(ctx, text, opts...)
+}
+
+// AnalyzeDocument is the version of AnalyzeDocumentWithContext with a background context
+func AnalyzeDocument(text string, opts ...DocumentOption) (*JSONTokens, error) {
+	return AnalyzeDocumentWithContext(context.Background(), text, opts...)
+}
+
+// textChunk is a part of a document, offset bytes and runeOffset runes from its start
+type textChunk struct {
+	text       string
+	offset     int
+	runeOffset int
+}
+
+// chunkText splits text into chunks of whole sentences of up to maxRunes runes,
+// unless a sentence is longer. Concatenating the chunks gives back text.
+func chunkText(text string, maxRunes int) []textChunk {
+	var chunks []textChunk
+	var current textChunk
+	var currentRunes, offset, runeOffset int
+	for _, sentence := range splitSentences(text) {
+		n := utf8.RuneCountInString(sentence)
+		if current.text != "" && currentRunes+n > maxRunes {
+			chunks = append(chunks, current)
+			current, currentRunes = textChunk{}, 0
+		}
+		if current.text == "" {
+			current.offset, current.runeOffset = offset, runeOffset
+		}
+		current.text += sentence
+		currentRunes += n
+		offset += len(sentence)
+		runeOffset += n
+	}
+	if current.text != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// splitSentences splits text after each sentence terminator or newline, along
+// with the closing brackets and whitespace that follow. Concatenating the
+// sentences gives back text.
+func splitSentences(text string) []string {
+	var sentences []string
+	var start int
+	var ended bool // whether the current sentence reached its end
+	for i, r := range text {
+		switch {
+		case r == '\n':
+			ended = true
+		case ended && (strings.ContainsRune(sentenceEnds+closingBrackets, r) || unicode.IsSpace(r)):
+			// Still part of the sentence that just ended
+		case ended:
+			sentences = append(sentences, text[start:i])
+			start, ended = i, false
+		}
+		if strings.ContainsRune(sentenceEnds, r) {
+			ended = true
+		}
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
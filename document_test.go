@@ -0,0 +1,97 @@
+package ichiran
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		text      string
+		sentences []string
+	}{
+		{"", nil},
+		{"こんにちは", []string{"こんにちは"}},
+		{"行く。来る。", []string{"行く。", "来る。"}},
+		{"本当？！ はい。", []string{"本当？！ ", "はい。"}},
+		{"「行こう。」と言った。", []string{"「行こう。」", "と言った。"}},
+		{"「はい」と言った", []string{"「はい」と言った"}},
+		{"一行目\n\n二行目\n", []string{"一行目\n\n", "二行目\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			assert.Equal(t, tt.sentences, splitSentences(tt.text))
+		})
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	text := "一つ。二つ。三つ目の文はとても長い。四つ。"
+	chunks := chunkText(text, 6)
+
+	var texts []string
+	var rebuilt string
+	for _, chunk := range chunks {
+		assert.Equal(t, len(rebuilt), chunk.offset)
+		assert.Equal(t, len([]rune(rebuilt)), chunk.runeOffset)
+		texts = append(texts, chunk.text)
+		rebuilt += chunk.text
+	}
+	assert.Equal(t, []string{"一つ。二つ。", "三つ目の文はとても長い。", "四つ。"}, texts)
+	assert.Equal(t, text, rebuilt)
+}
+
+// wordsOutput returns an output of ichiran made of a segmentation of words,
+// given as kana, followed by some text ichiran didn't analyze
+func wordsOutput(tail string, words ...string) string {
+	var entries []string
+	for _, word := range words {
+		entries = append(entries, fmt.Sprintf(`["%s",{"type":"KANA","text":"%s","kana":"%s"}]`, word, word, word))
+	}
+	return fmt.Sprintf(`[[[[%s],10]],"%s"]`, strings.Join(entries, ","), tail)
+}
+
+func TestAnalyzeDocument(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	text := "こんにちは。さようなら！\nありがとう"
+	for chunk, output := range map[string]string{
+		"こんにちは。":   wordsOutput("。", "こんにちは"),
+		"さようなら！\n": wordsOutput(`！\n`, "さようなら"),
+		"ありがとう":    wordsOutput("", "ありがとう"),
+	} {
+		require.NoError(t, saveRecording(dir, analyzeForm(chunk, 1), []byte(output)))
+	}
+	manager, err := NewManager(ctx, WithReplay(dir))
+	require.NoError(t, err)
+
+	var progress []string
+	tokens, err := manager.AnalyzeDocument(ctx, text, WithChunkSize(6), WithDocumentProgress(func(done, total int) {
+		progress = append(progress, fmt.Sprintf("%d/%d", done, total))
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"1/3", "2/3", "3/3"}, progress)
+	var surfaces []string
+	for _, token := range *tokens {
+		surfaces = append(surfaces, token.Surface)
+	}
+	assert.Equal(t, []string{"こんにちは", "。", "さようなら", "！", "\n", "ありがとう"}, surfaces)
+	assert.NoError(t, tokens.VerifyOffsets(text))
+
+	sayounara := (*tokens)[2]
+	assert.Equal(t, 6, sayounara.Start)
+	assert.Equal(t, 11, sayounara.End)
+	assert.Equal(t, "さようなら", text[sayounara.StartByte:sayounara.EndByte])
+
+	t.Run("failed chunk", func(t *testing.T) {
+		_, err := manager.AnalyzeDocument(ctx, text+"。またね", WithChunkSize(6), WithDocumentConcurrency(1))
+		assert.ErrorIs(t, err, ErrNoRecording)
+		assert.ErrorContains(t, err, "chunk 2")
+	})
+}
@@ -0,0 +1,117 @@
+package ichiran
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrContainerNotRunning is returned when the main container isn't running,
+	// e.g. it was stopped or hasn't been started with Init yet
+	ErrContainerNotRunning = errors.New("container is not running")
+	// ErrNoJSON is returned when ichiran produced no JSON at all, usually
+	// because it crashed or printed an error instead
+	ErrNoJSON = errors.New("no valid JSON line found in output")
+	// ErrCommandNotFound is returned when ichiran-cli isn't installed in the
+	// main container, which happens when it couldn't resolve domains while it
+	// was created
+	ErrCommandNotFound = errors.New("ichiran-cli: command not found")
+	// ErrCorruptDatabase is returned by CheckIntegrity when the database is
+	// missing tables or rows, or can't be read
+	ErrCorruptDatabase = errors.New("ichiran database is corrupt")
+	// ErrSessionBroken is returned when the stream to the persistent session
+	// failed or its process exited, as opposed to a *LispError: the session
+	// is restarted and the query may be retried
+	ErrSessionBroken = errors.New("ichiran session is broken")
+)
+
+// ExecError is returned when the ichiran-cli process, or another command run
+// in the containers, exited with an error
+type ExecError struct {
+	ExitCode int    // Exit code of the process
+	Stderr   string // What it printed on stderr
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("command failed with exit code %d: %s", e.ExitCode, e.Stderr)
+}
+
+// LispError is returned when ichiran signaled an error while evaluating the
+// query, through the persistent session or for a text of AnalyzeBatch. It is
+// about the input: retrying the query fails the same way.
+type LispError struct {
+	Message string // Message of the Lisp condition
+}
+
+func (e *LispError) Error() string {
+	return "lisp error: " + e.Message
+}
+
+// ParseError is returned when the JSON produced by ichiran doesn't have the
+// expected structure
+type ParseError struct {
+	Offset  int64  // Offset in bytes in the JSON of the value at fault, -1 if unknown
+	Snippet string // Beginning of the value at fault, or of the JSON if unknown
+	Err     error  // What is wrong with it
+}
+
+func (e *ParseError) Error() string {
+	if e.Offset < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (at offset %d)", e.Err, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// valueError tells which JSON value an error of decode.go is about
+type valueError struct {
+	value []byte
+	err   error
+}
+
+func (e *valueError) Error() string {
+	return e.err.Error()
+}
+
+func (e *valueError) Unwrap() error {
+	return e.err
+}
+
+// badValue marks err as caused by value
+func badValue(value []byte, err error) error {
+	return &valueError{value: value, err: err}
+}
+
+// newParseError returns a ParseError for err, which occurred while parsing
+// output, locating the value at fault as precisely as possible.
+func newParseError(output []byte, err error) *ParseError {
+	parseErr := &ParseError{Offset: -1, Snippet: snippet(output), Err: err}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		parseErr.Offset = syntaxErr.Offset
+		parseErr.Snippet = snippet(output[min(max(syntaxErr.Offset-1, 0), int64(len(output))):])
+		return parseErr
+	}
+
+	// The innermost value is the most precise. The value was copied while
+	// decoding, hence the search for its first occurrence.
+	var valueErr *valueError
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if v, ok := e.(*valueError); ok {
+			valueErr = v
+		}
+	}
+	if valueErr != nil {
+		parseErr.Snippet = snippet(valueErr.value)
+		if i := bytes.Index(output, bytes.TrimSpace(valueErr.value)); i >= 0 {
+			parseErr.Offset = int64(i)
+		}
+	}
+	return parseErr
+}
@@ -0,0 +1,117 @@
+package ichiran
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		offset  int64
+		snippet string
+	}{
+		{
+			name:    "unexpected fragment",
+			output:  `["ok", 42]`,
+			offset:  7,
+			snippet: "42",
+		},
+		{
+			name:    "innermost value",
+			output:  `[[[[["konnichiha",{"text":"こんにちは","score":"high"}]],550]]]`,
+			offset:  52,
+			snippet: `"high"`,
+		},
+		{
+			name:    "no tokens",
+			output:  `[]`,
+			offset:  -1,
+			snippet: "[]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAnalysis([]byte(tt.output))
+			var parseErr *ParseError
+			require.True(t, errors.As(err, &parseErr), "got %v", err)
+			assert.Equal(t, tt.offset, parseErr.Offset)
+			assert.Equal(t, tt.snippet, parseErr.Snippet)
+		})
+	}
+
+	t.Run("syntax error", func(t *testing.T) {
+		_, err := parseBatchAnalysis([]byte(`[1, }`), []string{"a"})
+		var parseErr *ParseError
+		require.True(t, errors.As(err, &parseErr), "got %v", err)
+		assert.Equal(t, int64(5), parseErr.Offset)
+		assert.Equal(t, "}", parseErr.Snippet)
+	})
+}
+
+func TestExecError(t *testing.T) {
+	ctx := context.Background()
+	command, _ := stubCLI(t, "")
+	manager, err := NewManager(ctx, WithNativeBackend(command))
+	require.NoError(t, err)
+
+	_, err = manager.Analyze(ctx, "fail")
+	var execErr *ExecError
+	require.True(t, errors.As(err, &execErr), "got %v", err)
+	assert.Equal(t, 3, execErr.ExitCode)
+	assert.Equal(t, "boom", execErr.Stderr)
+
+	_, err = manager.Analyze(ctx, "こんにちは")
+	assert.ErrorIs(t, err, ErrNoJSON)
+}
+
+func TestLispError(t *testing.T) {
+	t.Run("session", func(t *testing.T) {
+		s, server, lines := newTestSession(t)
+		go func() {
+			bufio.NewReader(server).ReadString('\n')
+			lines <- sessionBeginMarker
+			lines <- sessionErrorPrefix + "The variable FOO is unbound."
+			lines <- sessionEndMarker
+		}()
+
+		_, err := s.roundTrip(context.Background(), "foo")
+		var lispErr *LispError
+		require.True(t, errors.As(err, &lispErr), "got %v", err)
+		assert.Equal(t, "The variable FOO is unbound.", lispErr.Message)
+		assert.NotErrorIs(t, err, ErrSessionBroken)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		_, err := parseBatchAnalysis([]byte(`[{"error":"boom"}]`), []string{"boom"})
+		var lispErr *LispError
+		require.True(t, errors.As(err, &lispErr), "got %v", err)
+		assert.Equal(t, "boom", lispErr.Message)
+	})
+}
+
+func TestSessionBrokenError(t *testing.T) {
+	s, server, lines := newTestSession(t)
+	go func() {
+		bufio.NewReader(server).ReadString('\n')
+		close(lines)
+	}()
+
+	_, err := s.roundTrip(context.Background(), "(sb-ext:exit)")
+	assert.ErrorIs(t, err, ErrSessionBroken)
+	var lispErr *LispError
+	assert.False(t, errors.As(err, &lispErr))
+}
+
+func TestDNSFailureError(t *testing.T) {
+	err := dnsFailureError([]byte("bash: line 1: ichiran-cli: command not found"))
+	assert.ErrorIs(t, err, ErrCommandNotFound)
+	assert.ErrorContains(t, err, "domain resolution")
+}
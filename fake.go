@@ -0,0 +1,102 @@
+package ichiran
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrNoFixture is returned by FakeAnalyzer for a text it has no recorded output for
+var ErrNoFixture = errors.New("no recorded ichiran output for this text")
+
+// FakeAnalyzer is an Analyzer that doesn't need Docker: it replays outputs of
+// ichiran recorded beforehand, keyed by the analyzed text. The outputs are parsed
+// exactly like those of a live ichiran, so the tokens are the same.
+type FakeAnalyzer struct {
+	mu      sync.RWMutex
+	outputs map[string][]byte
+	closed  bool
+}
+
+// NewFakeAnalyzer returns a FakeAnalyzer replaying outputs, the JSON produced by
+// ichiran for each text. More can be added with Add.
+func NewFakeAnalyzer(outputs map[string][]byte) *FakeAnalyzer {
+	f := &FakeAnalyzer{outputs: make(map[string][]byte, len(outputs))}
+	for text, output := range outputs {
+		f.Add(text, output)
+	}
+	return f
+}
+
+// LoadFakeAnalyzer returns a FakeAnalyzer replaying the outputs of a fixture
+// file: a JSON object whose keys are texts and values the JSON ichiran produced
+// for them, e.g. {"こんにちは": [[[[["konnichiha", {...}, []]], 550]]]}
+func LoadFakeAnalyzer(path string) (*FakeAnalyzer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixtures: %w", err)
+	}
+	var fixtures map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("failed to decode fixtures %s: %w", path, err)
+	}
+	outputs := make(map[string][]byte, len(fixtures))
+	for text, output := range fixtures {
+		outputs[text] = output
+	}
+	return NewFakeAnalyzer(outputs), nil
+}
+
+// Add records output as the JSON produced by ichiran for text
+func (f *FakeAnalyzer) Add(text string, output []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outputs[text] = append([]byte(nil), output...)
+}
+
+// Analyze returns the tokens of the output recorded for text, or ErrNoFixture
+func (f *FakeAnalyzer) Analyze(ctx context.Context, text string) (*JSONTokens, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.RLock()
+	output, ok := f.outputs[text]
+	closed := f.closed
+	f.mu.RUnlock()
+	if closed {
+		return nil, fmt.Errorf("fake analyzer is closed")
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoFixture, text)
+	}
+
+	tokens, err := parseAnalysis(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output: %w", err)
+	}
+	alignTokens(text, *tokens)
+
+	return tokens, nil
+}
+
+// Status returns "running" until the FakeAnalyzer is closed, "closed" afterwards
+func (f *FakeAnalyzer) Status(ctx context.Context) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return "closed", nil
+	}
+	return "running", nil
+}
+
+// Close makes subsequent calls to Analyze fail
+func (f *FakeAnalyzer) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,88 @@
+package ichiran
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// kanaOf stands for downstream code that only knows about the Analyzer interface
+func kanaOf(ctx context.Context, analyzer Analyzer, text string) (string, error) {
+	tokens, err := analyzer.Analyze(ctx, text)
+	if err != nil {
+		return "", err
+	}
+	return tokens.Kana(), nil
+}
+
+// analyzeFixture analyzes text with the outputs of testdata/fake.json, for the
+// tests of the parsing and rendering of ichiran's analyses
+func analyzeFixture(t *testing.T, text string) *JSONTokens {
+	t.Helper()
+	analyzer, err := LoadFakeAnalyzer(filepath.Join("testdata", "fake.json"))
+	require.NoError(t, err)
+	tokens, err := analyzer.Analyze(context.Background(), text)
+	require.NoError(t, err)
+	return tokens
+}
+
+func TestFakeAnalyzer(t *testing.T) {
+	ctx := context.Background()
+	analyzer, err := LoadFakeAnalyzer(filepath.Join("testdata", "fake.json"))
+	require.NoError(t, err)
+
+	t.Run("replays recorded outputs", func(t *testing.T) {
+		kana, err := kanaOf(ctx, analyzer, "私は日本語を勉強しています。")
+		require.NoError(t, err)
+		assert.Equal(t, "わたしはにほんごをべんきょう しています。", kana)
+
+		text := "Hello, 世界! 2024 ♪\n"
+		tokens, err := analyzer.Analyze(ctx, text)
+		require.NoError(t, err)
+		assert.NoError(t, tokens.VerifyOffsets(text))
+		assert.Equal(t, "世界", (*tokens)[3].Surface)
+		assert.Equal(t, 7, (*tokens)[3].Start)
+	})
+
+	t.Run("unknown text", func(t *testing.T) {
+		_, err := analyzer.Analyze(ctx, "さようなら")
+		assert.ErrorIs(t, err, ErrNoFixture)
+	})
+
+	t.Run("added output", func(t *testing.T) {
+		analyzer.Add("こんにちは", []byte(konnichihaJSON))
+		kana, err := kanaOf(ctx, analyzer, "こんにちは")
+		require.NoError(t, err)
+		assert.Equal(t, "こんにちは", kana)
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := analyzer.Analyze(cancelled, "今日は")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		status, err := analyzer.Status(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "running", status)
+
+		require.NoError(t, analyzer.Close())
+		status, err = analyzer.Status(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "closed", status)
+
+		_, err = analyzer.Analyze(ctx, "今日は")
+		assert.Error(t, err)
+	})
+}
+
+func TestNewFakeAnalyzer(t *testing.T) {
+	analyzer := NewFakeAnalyzer(map[string][]byte{"こんにちは": []byte(`{"not": "ichiran"}`)})
+	_, err := analyzer.Analyze(context.Background(), "こんにちは")
+	assert.ErrorContains(t, err, "failed to parse output")
+}
@@ -1,10 +1,15 @@
 package ichiran
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
+	"unicode"
 
 	"al.essio.dev/pkg/shellescape"
 	"github.com/gookit/color"
@@ -24,6 +29,227 @@ func (im *IchiranManager) Analyze(ctx context.Context, text string) (*JSONTokens
 	queryCtx, cancel := context.WithTimeout(ctx, im.QueryTimeout)
 	defer cancel()
 
+	if im.memory != nil {
+		return im.memory.analyze(queryCtx, text, im.analyze)
+	}
+	return im.analyze(queryCtx, text)
+}
+
+// analyze queries ichiran for the analysis of text, see Analyze
+func (im *IchiranManager) analyze(ctx context.Context, text string) (*JSONTokens, error) {
+	query := im.queryText(text)
+	output, err := im.evalLisp(ctx, analyzeForm(query, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the JSON output into tokens
+	tokens, err := parseAnalysis(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output: %w", err)
+	}
+	alignTokens(query, *tokens)
+	realignTokens(text, query, *tokens)
+
+	return tokens, nil
+}
+
+// AnalyzeNBest returns up to n segmentations of text ranked by ichiran's score,
+// best first. The first one is the segmentation returned by Analyze.
+func (im *IchiranManager) AnalyzeNBest(ctx context.Context, text string, n int) ([]Segmentation, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of segmentations: %d", n)
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, im.QueryTimeout)
+	defer cancel()
+
+	query := im.queryText(text)
+	output, err := im.evalLisp(queryCtx, analyzeForm(query, n))
+	if err != nil {
+		return nil, err
+	}
+
+	segmentations, err := parseSegmentations(output, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output: %w", err)
+	}
+	for _, segmentation := range segmentations {
+		alignTokens(query, segmentation.Tokens)
+		realignTokens(text, query, segmentation.Tokens)
+	}
+
+	return segmentations, nil
+}
+
+// BatchError is returned by AnalyzeBatch when some of the texts couldn't be analyzed.
+type BatchError struct {
+	// Errs is aligned with the input texts, nil for the texts that were analyzed.
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	var failed int
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d texts failed to be analyzed, first error: %v", failed, len(e.Errs), first)
+}
+
+// Unwrap gives errors.Is and errors.As access to the per-text errors
+func (e *BatchError) Unwrap() []error {
+	return e.Errs
+}
+
+// AnalyzeBatch analyzes many texts in a single call to ichiran. The returned slice
+// is aligned with texts. If some texts fail, the others are still returned
+// and the error is a *BatchError telling which ones failed (their tokens are nil).
+// Any other error means the whole batch failed.
+func (im *IchiranManager) AnalyzeBatch(ctx context.Context, texts []string) ([]*JSONTokens, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, im.QueryTimeout)
+	defer cancel()
+
+	queries := make([]string, len(texts))
+	for i, text := range texts {
+		queries[i] = im.queryText(text)
+	}
+	output, err := im.evalLisp(queryCtx, analyzeBatchForm(queries))
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := parseBatchAnalysis(output, queries)
+	for i, tokens := range results {
+		if tokens != nil {
+			realignTokens(texts[i], queries[i], *tokens)
+		}
+	}
+	return results, err
+}
+
+// parseBatchAnalysis splits the JSON array produced by analyzeBatchForm and
+// parses each of its items with parseAnalysis, aligning them with texts.
+func parseBatchAnalysis(output []byte, texts []string) ([]*JSONTokens, error) {
+	n := len(texts)
+	var items []json.RawMessage
+	if err := json.Unmarshal(output, &items); err != nil {
+		return nil, fmt.Errorf("failed to decode batch output: %w", newParseError(output, err))
+	}
+	if len(items) != n {
+		return nil, newParseError(output, fmt.Errorf("expected %d results in batch output, got %d", n, len(items)))
+	}
+
+	results := make([]*JSONTokens, n)
+	errs := make([]error, n)
+	failed := false
+	for i, item := range items {
+		var itemErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(item, &itemErr) == nil {
+			errs[i] = &LispError{Message: itemErr.Error}
+			failed = true
+			continue
+		}
+		tokens, err := parseAnalysis(item)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to parse output: %w", err)
+			failed = true
+			continue
+		}
+		alignTokens(texts[i], *tokens)
+		results[i] = tokens
+	}
+
+	if failed {
+		return results, &BatchError{Errs: errs}
+	}
+	return results, nil
+}
+
+// evalLisp evaluates form with ichiran and returns the JSON it produced, either
+// through the persistent session or through a dedicated ichiran-cli process,
+// in the container or on the host for the native backend. In replay mode, the
+// JSON comes from the recordings, in recording mode it is saved to them.
+// With WithCache, the JSON is looked up in the analysis cache first. Queries
+// wait for Upgrade and the other operations of withoutRecovery, as long as ctx
+// allows.
+func (im *IchiranManager) evalLisp(ctx context.Context, form string) ([]byte, error) {
+	if im.replayDir != "" {
+		return loadRecording(im.replayDir, form)
+	}
+
+	if err := im.stackSem.Acquire(ctx, 1); err != nil {
+		return nil, fmt.Errorf("query canceled while waiting for maintenance: %w", err)
+	}
+	defer im.stackSem.Release(1)
+
+	var key string
+	if im.cache != nil {
+		var err error
+		if key, err = im.cacheKey(ctx, form); err != nil {
+			Logger.Debug().Err(err).Msg("analysis cache bypassed")
+		} else if output, ok := im.cache.get(key); ok {
+			return output, nil
+		}
+	}
+
+	output, err := im.evalLispLive(ctx, form)
+	if err != nil {
+		return nil, err
+	}
+	if im.recordDir != "" {
+		if err := saveRecording(im.recordDir, form, output); err != nil {
+			Logger.Warn().Err(err).Msg("failed to record ichiran output")
+		}
+	}
+	if key != "" {
+		if err := im.cache.put(key, output); err != nil {
+			Logger.Warn().Err(err).Msg("failed to cache ichiran output")
+		}
+	}
+	return output, nil
+}
+
+// evalLispLive evaluates form with ichiran itself, see evalLisp, waiting for a
+// slot first if the number of concurrent queries is limited
+func (im *IchiranManager) evalLispLive(ctx context.Context, form string) ([]byte, error) {
+	if im.limiter != nil {
+		if err := im.limiter.acquire(ctx); err != nil {
+			return nil, fmt.Errorf("query canceled while waiting in queue: %w", err)
+		}
+		defer im.limiter.release()
+	}
+
+	if im.recovery != nil && im.usesDocker() {
+		return im.evalLispRecovering(ctx, form)
+	}
+	return im.evalLispOnce(ctx, form)
+}
+
+// evalLispOnce evaluates form with the backend of the manager, see evalLispLive
+func (im *IchiranManager) evalLispOnce(ctx context.Context, form string) ([]byte, error) {
+	if im.isNative() {
+		return im.execNativeLisp(ctx, form)
+	}
+	if im.session != nil {
+		return im.session.eval(ctx, form)
+	}
+	return im.execLisp(ctx, form)
+}
+
+// execLisp runs a new ichiran-cli process in the main container to evaluate form.
+func (im *IchiranManager) execLisp(ctx context.Context, form string) ([]byte, error) {
 	// Get Docker client
 	client, err := im.docker.GetClient()
 	if err != nil {
@@ -31,56 +257,32 @@ func (im *IchiranManager) Analyze(ctx context.Context, text string) (*JSONTokens
 	}
 
 	// Check container status
-	containerInfo, err := client.ContainerInspect(queryCtx, im.containerName)
+	containerInfo, err := client.ContainerInspect(ctx, im.containerName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to inspect container: %w", err)
 	}
 
 	if !containerInfo.State.Running {
-		return nil, fmt.Errorf("container %s is not running", im.containerName)
-	}
-
-	// Load the optimized Lisp snippet and replace the placeholder
-	lispCode := fmt.Sprintf(`(progn
-    (ql:quickload :jsown :silent t)
-    
-    (defmethod jsown:to-json ((word-info ichiran/dict::word-info))
-      (let* ((gloss-json (handler-case
-                            (ichiran::word-info-gloss-json word-info)
-                          (error (e) (declare (ignore e)) nil)))
-             (match-json (handler-case
-                            (ichiran/kanji:match-readings-json
-                              (slot-value word-info (quote ichiran/dict::text))
-                              (slot-value word-info (quote ichiran/dict::kana)))
-                          (error (e) (declare (ignore e)) nil)))
-             
-             (word-json (ichiran::word-info-json word-info)))
-        
-        (when gloss-json
-          (jsown:extend-js word-json ("gloss" gloss-json)))
-        
-        (when match-json
-          (jsown:extend-js word-json ("match" match-json)))
-        
-        (jsown:to-json word-json)))
-    
-    (jsown:to-json (ichiran::romanize* "%s" :limit 1)))`, text)
-
-	// Remove Lisp comments and clean up the code for the shell command
-	lispCode = cleanLispCode(lispCode)
-
-	// Prepare command
-	execCommand := fmt.Sprintf("ichiran-cli -e '%s'", lispCode)
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotRunning, im.containerName)
+	}
+
+	// Prepare command: the program is constant, the form (and the user input
+	// it contains) is sent through stdin
+	execCommand := "ichiran-cli -e " + safe(oneShotProgram())
 	cmd := []string{
 		"bash",
 		"-c",
 		execCommand,
 	}
 
-	// Create execution config
+	// Create execution config. The environment tags the process so that it
+	// can be killed if the query is canceled.
+	queryID := newQueryID()
 	execConfig := container.ExecOptions{
 		User:         containerInfo.Config.User,
 		Cmd:          cmd,
+		Env:          queryEnv(queryID),
+		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
 		Tty:          false,
@@ -88,42 +290,67 @@ func (im *IchiranManager) Analyze(ctx context.Context, text string) (*JSONTokens
 	}
 
 	// Create execution
-	exec, err := client.ContainerExecCreate(queryCtx, im.containerName, execConfig)
+	exec, err := client.ContainerExecCreate(ctx, im.containerName, execConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create exec: %w", err)
 	}
 
+	// Attaching starts the process, which would otherwise keep running, so it
+	// is killed if ctx is done or if the attach failed midway
+	attached := false
+	defer func() {
+		if !attached || ctx.Err() != nil {
+			im.killQuery(containerInfo.Config.User, queryID)
+		}
+	}()
+
 	// Attach to execution
-	resp, err := client.ContainerExecAttach(queryCtx, exec.ID, container.ExecStartOptions{})
+	resp, err := client.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to attach to exec: %w", err)
 	}
+	attached = true
 	defer resp.Close()
 
+	// Closing the connection unblocks the reads when ctx is done
+	stop := context.AfterFunc(ctx, func() { resp.Close() })
+	defer stop()
+
+	// Send the form then close stdin
+	if _, err := io.WriteString(resp.Conn, form); err != nil {
+		return nil, fmt.Errorf("failed to send form: %w", err)
+	}
+	if err := resp.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("failed to close stdin: %w", err)
+	}
+
 	// Extract JSON from the output
-	output, err := extractJSONFromDockerOutput(queryCtx, resp.Reader)
+	var stderr bytes.Buffer
+	output, err := extractJSONFromDockerOutput(ctx, resp.Reader, &stderr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read exec output: %w", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// A failed process usually outputs no JSON: report its failure instead
+		if !errors.Is(err, ErrNoJSON) {
+			return nil, fmt.Errorf("failed to read exec output: %w", err)
+		}
 	}
 
 	// Check execution status
-	inspect, err := client.ContainerExecInspect(queryCtx, exec.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to inspect exec: %w", err)
+	inspect, inspectErr := client.ContainerExecInspect(ctx, exec.ID)
+	if inspectErr != nil {
+		return nil, fmt.Errorf("failed to inspect exec: %w", inspectErr)
 	}
 
 	if inspect.ExitCode != 0 {
-		return nil, fmt.Errorf("command failed with exit code %d: %s",
-			inspect.ExitCode, string(output))
+		return nil, &ExecError{ExitCode: inspect.ExitCode, Stderr: strings.TrimSpace(stderr.String())}
 	}
-
-	// Parse the JSON output into tokens
-	tokens, err := parseAnalysis(output)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse output: %w", err)
+		return nil, fmt.Errorf("failed to read exec output: %w", err)
 	}
 
-	return tokens, nil
+	return output, nil
 }
 
 // AnalyzeWithContext is the context-aware version for analyzing text
@@ -203,416 +430,278 @@ func stringCapLen(s string, max int) string {
 // This function handles the complex nested JSON structure including readings,
 // translations, and kanji-kana mappings.
 func parseAnalysis(output []byte) (*JSONTokens, error) {
-	// First, unmarshal the JSON into a nested structure
-	var rawData interface{}
-	if err := json.Unmarshal(output, &rawData); err != nil {
-		return nil, fmt.Errorf("failed to decode JSON output: %w", err)
+	// The JSON structure is deeply nested with mixed arrays and objects:
+	// it is decoded into the types of decode.go
+	var analysis rawAnalysis
+	if err := json.Unmarshal(output, &analysis); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON output: %w", newParseError(output, err))
 	}
 
-	// Debug view of the JSON structure
-	Logger.Debug().Msgf("Raw JSON structure type: %T", rawData)
-
 	var tokens JSONTokens
-
-	// Try to detect the structure format and process it
-	// The JSON structure is deeply nested with mixed arrays and objects
-
-	// Extract the main words array which is deeply nested
-	// We need to navigate through multiple layers of arrays to get to the tokens
-	wordsArray, err := extractWordsArray(rawData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to extract words: %w", err)
-	}
-
-	// Now process each word entry
-	for _, wordEntry := range wordsArray {
-		// A word entry is typically ["romanji", {word data...}, []]
-		wordSlice, ok := wordEntry.([]interface{})
-		if !ok || len(wordSlice) < 2 {
-			// Skip entries that don't match expected format
+	for _, fragment := range analysis {
+		if fragment.IsText {
+			tokens = append(tokens, textTokens(fragment.Text)...)
 			continue
 		}
-
-		// The word data is in the second position of the slice
-		wordData, ok := wordSlice[1].(map[string]interface{})
-		if !ok {
-			// Skip entries with invalid word data
+		// The segmentations are ranked best first
+		if len(fragment.Segmentations) == 0 {
 			continue
 		}
-
-		// Create and populate a new token
-		token := &JSONToken{
-			IsLexical: true, // Assume true until proven otherwise
-			Raw:       nil,  // Store raw JSON for future use
-		}
-
-		// Extract the type - determines if lexical or not
-		tokenType, _ := wordData["type"].(string)
-		if tokenType == "KANA" {
-			// Kana tokens are lexical
-			token.IsLexical = true
-		} else if tokenType == "KANJI" {
-			// Kanji tokens are lexical
-			token.IsLexical = true
-		} else if tokenType == "PUNCT" {
-			// Punctuation tokens are not lexical
-			token.IsLexical = false
-		} else {
-			// Other token types may not be lexical
-			token.IsLexical = false
-		}
-
-		// Extract basic fields
-		if text, ok := wordData["text"].(string); ok {
-			token.Surface = text
-		}
-		if kana, ok := wordData["kana"].(string); ok {
-			token.Kana = kana
-		}
-		if score, ok := wordData["score"].(float64); ok {
-			token.Score = int(score)
-		}
-		if seq, ok := wordData["seq"].(float64); ok {
-			token.Seq = int(seq)
-		}
-
-		// Get romanized form - usually in position 0 of the entry
-		if romanji, ok := wordSlice[0].(string); ok {
-			token.Romaji = romanji
-		}
-
-		// Extract the reading from the gloss if available
-		if glossData, ok := wordData["gloss"].(map[string]interface{}); ok {
-			// The reading is sometimes in the gloss object
-			if reading, ok := glossData["reading"].(string); ok {
-				token.Reading = reading
-			}
-
-			// Extract gloss entries
-			if glossEntries, ok := glossData["gloss"].([]interface{}); ok {
-				for _, g := range glossEntries {
-					if glossMap, ok := g.(map[string]interface{}); ok {
-						gloss := Gloss{}
-
-						if pos, ok := glossMap["pos"].(string); ok {
-							gloss.Pos = pos
-						}
-						if glossText, ok := glossMap["gloss"].(string); ok {
-							gloss.Gloss = glossText
-						}
-						if info, ok := glossMap["info"].(string); ok {
-							gloss.Info = info
-						}
-
-						token.Gloss = append(token.Gloss, gloss)
-					}
-				}
-			}
-		}
-
-		// Extract conjugation information if available
-		if conjData, ok := wordData["conj"].([]interface{}); ok {
-			for _, c := range conjData {
-				if conjMap, ok := c.(map[string]interface{}); ok {
-					conj := Conj{}
-
-					if reading, ok := conjMap["reading"].(string); ok {
-						conj.Reading = reading
-					}
-					if readOk, ok := conjMap["readok"].(bool); ok {
-						conj.ReadOk = readOk
-					}
-
-					// Extract properties
-					if propData, ok := conjMap["prop"].([]interface{}); ok {
-						for _, p := range propData {
-							if propMap, ok := p.(map[string]interface{}); ok {
-								prop := Prop{}
-
-								if pos, ok := propMap["pos"].(string); ok {
-									prop.Pos = pos
-								}
-								if propType, ok := propMap["type"].(string); ok {
-									prop.Type = propType
-								}
-								if neg, ok := propMap["neg"].(bool); ok {
-									prop.Neg = neg
-								}
-
-								conj.Prop = append(conj.Prop, prop)
-							}
-						}
-					}
-
-					// Extract gloss entries for this conjugation
-					if glossEntries, ok := conjMap["gloss"].([]interface{}); ok {
-						for _, g := range glossEntries {
-							if glossMap, ok := g.(map[string]interface{}); ok {
-								gloss := Gloss{}
-
-								if pos, ok := glossMap["pos"].(string); ok {
-									gloss.Pos = pos
-								}
-								if glossText, ok := glossMap["gloss"].(string); ok {
-									gloss.Gloss = glossText
-								}
-								if info, ok := glossMap["info"].(string); ok {
-									gloss.Info = info
-								}
-
-								conj.Gloss = append(conj.Gloss, gloss)
-							}
-						}
-					}
-
-					token.Conj = append(token.Conj, conj)
-				}
-			}
-		}
-
-		// Extract kanji-kana mapping information if available
-		if matchData, ok := wordData["match"].([]interface{}); ok {
-			var readings []KanjiReading
-
-			for _, m := range matchData {
-				if matchMap, ok := m.(map[string]interface{}); ok {
-					reading := KanjiReading{}
-
-					if kanji, ok := matchMap["kanji"].(string); ok {
-						reading.Kanji = kanji
-					}
-					if kana, ok := matchMap["reading"].(string); ok {
-						reading.Reading = kana
-					}
-					if readingType, ok := matchMap["type"].(string); ok {
-						reading.Type = readingType
-					}
-					if link, ok := matchMap["link"].(bool); ok {
-						reading.Link = link
-					}
-					if gem, ok := matchMap["geminated"].(string); ok {
-						reading.Geminated = gem
-					}
-					if stats, ok := matchMap["stats"].(bool); ok {
-						reading.Stats = stats
-					}
-					if sample, ok := matchMap["sample"].(float64); ok {
-						reading.Sample = int(sample)
-					}
-					if total, ok := matchMap["total"].(float64); ok {
-						reading.Total = int(total)
-					}
-					if perc, ok := matchMap["perc"].(string); ok {
-						reading.Perc = perc
-					}
-					if grade, ok := matchMap["grade"].(float64); ok {
-						reading.Grade = int(grade)
-					}
-
-					readings = append(readings, reading)
-				} else if text, ok := matchMap["text"].(string); ok {
-					// This is likely a full text segment, not a kanji reading
-					// We can create a special entry if needed
-					_ = text // Currently not used
-				}
-			}
-
-			// Decode Unicode escapes in the readings
-			for i := range readings {
-				readings[i].Kanji, _ = unescapeUnicodeString(readings[i].Kanji)
-				readings[i].Reading, _ = unescapeUnicodeString(readings[i].Reading)
-			}
-			token.KanjiReadings = readings
-		}
-
-		// Extract components data if available (for compound words)
-		if componentsData, ok := wordData["components"].([]interface{}); ok {
-			for _, comp := range componentsData {
-				if compMap, ok := comp.(map[string]interface{}); ok {
-					component := JSONToken{}
-
-					if text, ok := compMap["text"].(string); ok {
-						component.Surface = text
-					}
-					if kana, ok := compMap["kana"].(string); ok {
-						component.Kana = kana
-					}
-					if reading, ok := compMap["reading"].(string); ok {
-						component.Reading = reading
-					}
-					if score, ok := compMap["score"].(float64); ok {
-						component.Score = int(score)
-					}
-
-					// Extract gloss for the component
-					if glossData, ok := compMap["gloss"].(map[string]interface{}); ok {
-						if glossEntries, ok := glossData["gloss"].([]interface{}); ok {
-							for _, g := range glossEntries {
-								if glossMap, ok := g.(map[string]interface{}); ok {
-									gloss := Gloss{}
-
-									if pos, ok := glossMap["pos"].(string); ok {
-										gloss.Pos = pos
-									}
-									if glossText, ok := glossMap["gloss"].(string); ok {
-										gloss.Gloss = glossText
-									}
-									if info, ok := glossMap["info"].(string); ok {
-										gloss.Info = info
-									}
-
-									component.Gloss = append(component.Gloss, gloss)
-								}
-							}
-						}
-					}
-
-					token.Components = append(token.Components, component)
-				}
-			}
-		}
-
-		// Decode Unicode escapes in strings
-		if err := decodeToken(token); err != nil {
-			return nil, fmt.Errorf("failed to decode token: %w", err)
+		words, err := wordTokens(fragment.Segmentations[0].Entries)
+		if err != nil {
+			return nil, err
 		}
+		tokens = append(tokens, words...)
+	}
 
-		tokens = append(tokens, token)
+	if len(tokens) == 0 {
+		return nil, newParseError(output, errors.New("could not find any tokens in the JSON structure"))
 	}
 
+	Logger.Debug().Msgf("Found %d total tokens (words and other text)", len(tokens))
 	return &tokens, nil
 }
 
-// extractWordsArray traverses the JSON structure to find all words and punctuation
-func extractWordsArray(data interface{}) ([]interface{}, error) {
-	// First level is typically an array
-	outerArray, ok := data.([]interface{})
-	if !ok || len(outerArray) == 0 {
-		return nil, fmt.Errorf("expected outer array structure")
-	}
-
-	// We'll collect all entries (words and punctuation) here
-	var allEntries []interface{}
-
-	// Process the top-level array which contains a mix of nested word arrays and punctuation strings
-	for _, item := range outerArray {
-		// Check if this is a string (punctuation)
-		if punctStr, isPunct := item.(string); isPunct && strings.TrimSpace(punctStr) != "" {
-			// Create a token for punctuation
-			punctToken := []interface{}{
-				punctStr, // First element is the punctuation mark itself
-				map[string]interface{}{ // Second element is token metadata
-					"type":    "PUNCT",
-					"text":    punctStr,
-					"kana":    punctStr,
-					"reading": punctStr,
-				},
-				[]interface{}{}, // Third element (usually alternative forms) is empty
-			}
-			allEntries = append(allEntries, punctToken)
-			continue
+// wordTokens turns the word entries of a segmentation into tokens
+func wordTokens(entries []rawWordEntry) (JSONTokens, error) {
+	tokens := make(JSONTokens, 0, len(entries))
+	for _, entry := range entries {
+		token, err := newWordToken(entry.Romaji, &entry.Word)
+		if err != nil {
+			return nil, err
 		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
 
-		// If not a punctuation string, it should be a nested array containing word data
-		nestedArray, isArray := item.([]interface{})
-		if !isArray {
-			// Skip anything that's not a string or array
-			continue
+// newWordToken builds a token from a word of ichiran's JSON.
+// romaji is given by the word entry enclosing the word, if any.
+func newWordToken(romaji string, word *rawWord) (*JSONToken, error) {
+	kind, known := tokenKinds[word.Type]
+	if !known {
+		// Other token types are not Japanese words
+		kind = TokenSymbol
+	}
+
+	token := &JSONToken{
+		Surface:   word.Text,
+		Kind:      kind,
+		IsLexical: kind == TokenWord,
+		Kana:      string(word.Kana),
+		Score:     int(word.Score),
+		Seq:       int(word.Seq),
+		Conj:      word.Conj,
+		Compound:  word.Compound,
+		Raw:       word.raw,
+	}
+
+	// Get romanized form - usually in position 0 of the entry, nested
+	// words have theirs in the word data
+	token.Romaji = romaji
+	if token.Romaji == "" {
+		token.Romaji = word.Romaji
+	}
+
+	// Words nested in another word (e.g. alternatives) carry their reading
+	// directly, the others along with their glosses
+	token.Reading = word.Reading
+	if word.Gloss.Reading != "" {
+		token.Reading = word.Gloss.Reading
+	}
+	token.Gloss = word.Gloss.Glosses
+
+	// Decode Unicode escapes in the kanji-kana mappings
+	for _, reading := range word.Match {
+		reading.Kanji, _ = unescapeUnicodeString(reading.Kanji)
+		reading.Reading, _ = unescapeUnicodeString(reading.Reading)
+		token.KanjiReadings = append(token.KanjiReadings, reading)
+	}
+
+	// Components of compound words are words on their own and are parsed with the same depth
+	for i := range word.Components {
+		component, err := newNestedToken(&word.Components[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse component: %w", err)
 		}
+		token.Components = append(token.Components, *component)
+	}
 
-		// Extract all word entries from this nested array
-		wordEntries := extractAllWordEntries(nestedArray)
-		if len(wordEntries) > 0 {
-			allEntries = append(allEntries, wordEntries...)
-			continue
+	// With alternative interpretations, the word describes each of them
+	// rather than the word itself
+	for i := range word.Alternative {
+		alternative, err := newNestedToken(&word.Alternative[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse alternative: %w", err)
 		}
+		token.Alternative = append(token.Alternative, *alternative)
+	}
 
-		// If we couldn't extract using recursive search, check if this already is a formatted word entry
-		if isFormattedWordEntry(nestedArray) {
-			allEntries = append(allEntries, nestedArray)
-			continue
-		}
+	// Decode Unicode escapes in strings
+	if err := decodeToken(token); err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
 	}
 
-	if len(allEntries) == 0 {
-		return nil, fmt.Errorf("could not find any tokens in the JSON structure")
+	// The first alternative is the one ichiran ranked best and romanized:
+	// it spearheads the token
+	if len(token.Alternative) > 0 {
+		token.Alternative[0].Romaji = token.Romaji
+		token.applyCore(extractCore(token.Alternative[0]))
+		if len(token.KanjiReadings) == 0 {
+			token.KanjiReadings = token.Alternative[0].KanjiReadings
+		}
 	}
 
-	Logger.Debug().Msgf("Found %d total entries (words and punctuation)", len(allEntries))
-	return allEntries, nil
+	return token, nil
 }
 
-// extractAllWordEntries finds all word entries in a nested array structure recursively
-func extractAllWordEntries(arr []interface{}) []interface{} {
-	var entries []interface{}
-
-	// Base case: Check if current array is a word entry
-	if isFormattedWordEntry(arr) {
-		return []interface{}{arr}
+// newNestedToken builds a token from a component or an alternative of a word,
+// which are always Japanese words even when ichiran doesn't tell their type.
+func newNestedToken(word *rawWord) (*JSONToken, error) {
+	token, err := newWordToken("", word)
+	if err != nil {
+		return nil, err
 	}
-
-	// Recursively check each element in the array
-	for _, item := range arr {
-		// If item is an array, process it
-		if nestedArr, isArray := item.([]interface{}); isArray {
-			// Try to find word entries at this level
-			wordEntries := extractAllWordEntries(nestedArr)
-			if len(wordEntries) > 0 {
-				entries = append(entries, wordEntries...)
-			}
-		}
+	if word.Type == "" {
+		token.Kind = TokenWord
+		token.IsLexical = true
 	}
-
-	return entries
+	return token, nil
 }
 
-// extractWordEntry tries to extract a single word entry from a nested array structure
-// typically in the format [[[[["romaji", {word data}, []]], score]]]
-func extractWordEntry(arr []interface{}) []interface{} {
-	// Common pattern of nesting for word entries
-	if len(arr) == 0 {
-		return nil
-	}
+// tokenKinds maps the types of ichiran's words to the kind of the resulting tokens
+var tokenKinds = map[string]TokenKind{
+	"KANJI": TokenWord,
+	"KANA":  TokenWord,
+}
 
-	// Navigate through the nested structure
-	current := arr
-	for len(current) > 0 {
-		// Check if current is a valid word entry format
-		if isFormattedWordEntry(current) {
-			return current
+// textTokens creates tokens for the text found between the Japanese fragments,
+// which ichiran passes through as is. The text is split in runs of whitespace,
+// letters, numbers, punctuation and symbols, each run being a token.
+func textTokens(text string) (tokens JSONTokens) {
+	runes := []rune(text)
+	for start := 0; start < len(runes); {
+		kind := runeKind(runes[start])
+		end := start + 1
+		for end < len(runes) {
+			next := runeKind(runes[end])
+			// A decimal or thousands separator followed by a digit belongs to the number
+			if kind == TokenNumber && (runes[end] == '.' || runes[end] == ',') &&
+				end+1 < len(runes) && runeKind(runes[end+1]) == TokenNumber {
+				next = TokenNumber
+			}
+			if next != kind {
+				break
+			}
+			end++
 		}
+		run := string(runes[start:end])
+		tokens = append(tokens, &JSONToken{
+			Surface:   run,
+			Kind:      kind,
+			IsLexical: kind == TokenWord,
+			Reading:   run,
+			Kana:      run,
+			Romaji:    run,
+		})
+		start = end
+	}
+	return
+}
 
-		// Go one level deeper
-		nextArr, ok := current[0].([]interface{})
-		if !ok {
-			break
-		}
-		current = nextArr
+// runeKind classifies a character found outside of the Japanese fragments
+func runeKind(r rune) TokenKind {
+	switch {
+	case unicode.IsSpace(r):
+		return TokenWhitespace
+	case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+		// Japanese that ichiran couldn't make sense of
+		return TokenWord
+	case unicode.IsLetter(r) || unicode.Is(unicode.Mn, r):
+		return TokenLatin
+	case unicode.IsDigit(r):
+		return TokenNumber
+	case unicode.IsPunct(r):
+		return TokenPunctuation
+	default:
+		return TokenSymbol
 	}
-
-	return nil
 }
 
-// isFormattedWordEntry checks if an array matches the expected format for a word entry
-// Word entries have the format ["romaji", {word data}, []]
-func isFormattedWordEntry(arr []interface{}) bool {
-	if len(arr) < 2 {
-		return false
-	}
+// parseSegmentations parses the output of romanize* called with :limit n into
+// the n best segmentations of the whole text.
+//
+// Each Japanese fragment of the text comes with up to n alternative segmentations.
+// The segmentations of the whole text are combinations of those of the fragments,
+// ranked by the sum of their scores.
+func parseSegmentations(output []byte, n int) ([]Segmentation, error) {
+	var analysis rawAnalysis
+	if err := json.Unmarshal(output, &analysis); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON output: %w", newParseError(output, err))
+	}
+
+	// A candidate picks one segmentation of each Japanese fragment
+	type candidate struct {
+		parts []rawFragment
+		score int
+	}
+
+	// Best combinations of the fragments seen so far
+	combos := []candidate{{}}
+	for _, fragment := range analysis {
+		var alternatives []candidate
+		if fragment.IsText && fragment.Text != "" {
+			alternatives = append(alternatives, candidate{parts: []rawFragment{fragment}})
+		}
+		for _, seg := range fragment.Segmentations {
+			alternatives = append(alternatives, candidate{
+				parts: []rawFragment{{Segmentations: []rawSegmentation{seg}}},
+				score: seg.Score,
+			})
+		}
+		if len(alternatives) == 0 {
+			continue
+		}
 
-	// First element should be a string (romaji)
-	_, isString := arr[0].(string)
-	if !isString {
-		return false
+		next := make([]candidate, 0, len(combos)*len(alternatives))
+		for _, combo := range combos {
+			for _, alt := range alternatives {
+				parts := append(append([]rawFragment{}, combo.parts...), alt.parts...)
+				next = append(next, candidate{parts: parts, score: combo.score + alt.score})
+			}
+		}
+		// Scores add up: the n best combinations can only extend the n best so far
+		slices.SortStableFunc(next, func(a, b candidate) int {
+			return b.score - a.score
+		})
+		combos = next[:min(n, len(next))]
+	}
+
+	var segmentations []Segmentation
+	for _, combo := range combos {
+		var tokens JSONTokens
+		for _, part := range combo.parts {
+			if part.IsText {
+				tokens = append(tokens, textTokens(part.Text)...)
+				continue
+			}
+			words, err := wordTokens(part.Segmentations[0].Entries)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, words...)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		segmentations = append(segmentations, Segmentation{Tokens: tokens, Score: combo.score})
 	}
 
-	// Second element should be a map (word data)
-	_, isMap := arr[1].(map[string]interface{})
-	if !isMap {
-		return false
+	if len(segmentations) == 0 {
+		return nil, newParseError(output, errors.New("could not find any tokens in the JSON structure"))
 	}
 
-	return true
+	return segmentations, nil
 }
 
 func placeholder() {
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 
@@ -247,4 +248,217 @@ func TestSafe(t *testing.T) {
 			assert.Equal(t, tt.expected, result)
 		})
 	}
-}
\ No newline at end of file
+}
+
+// konnichihaJSON is what the analysis form yields for "こんにちは"
+const konnichihaJSON = `[[[[["konnichiha",{"type":"KANA","text":"こんにちは","kana":"こんにちは","score":550,"seq":1289400,"gloss":{"reading":"こんにちは","gloss":[{"pos":"[int]","gloss":"hello; good day; good afternoon"}]}},[]]],550]]]`
+
+func TestParseBatchAnalysis(t *testing.T) {
+	t.Run("all succeed", func(t *testing.T) {
+		output := `[` + konnichihaJSON + `,` + konnichihaJSON + `]`
+		results, err := parseBatchAnalysis([]byte(output), []string{"こんにちは", "こんにちは"})
+		assert.NoError(t, err)
+		assert.Len(t, results, 2)
+		for _, tokens := range results {
+			assert.Equal(t, "こんにちは", (*tokens)[0].Surface)
+			assert.Equal(t, "konnichiha", (*tokens)[0].Romaji)
+			assert.Equal(t, 5, (*tokens)[0].End)
+		}
+	})
+
+	t.Run("per-item errors", func(t *testing.T) {
+		output := `[{"error":"boom"},` + konnichihaJSON + `,[]]`
+		results, err := parseBatchAnalysis([]byte(output), []string{"boom", "こんにちは", ""})
+
+		var batchErr *BatchError
+		assert.ErrorAs(t, err, &batchErr)
+		assert.Len(t, batchErr.Errs, 3)
+		assert.ErrorContains(t, batchErr.Errs[0], "boom")
+		assert.NoError(t, batchErr.Errs[1])
+		assert.Error(t, batchErr.Errs[2])
+		assert.Contains(t, err.Error(), "2 of 3")
+
+		assert.Nil(t, results[0])
+		assert.Equal(t, "こんにちは", (*results[1])[0].Surface)
+		assert.Nil(t, results[2])
+	})
+
+	t.Run("misaligned output", func(t *testing.T) {
+		_, err := parseBatchAnalysis([]byte(`[`+konnichihaJSON+`]`), []string{"こんにちは", "こんにちは"})
+		assert.Error(t, err)
+	})
+}
+
+func TestParseSegmentations(t *testing.T) {
+	// "今日、晴れ" analyzed with :limit 2: two segmentations for "今日", one for "晴れ"
+	output := `[
+		[
+			[[["kyō",{"type":"KANJI","text":"今日","kana":"きょう","score":300}]],300],
+			[[["konnichi",{"type":"KANJI","text":"今日","kana":"こんにち","score":200}]],200]
+		],
+		"、",
+		[
+			[[["hare",{"type":"KANJI","text":"晴れ","kana":"はれ","score":100}]],100]
+		]
+	]`
+
+	segmentations, err := parseSegmentations([]byte(output), 2)
+	assert.NoError(t, err)
+	assert.Len(t, segmentations, 2)
+
+	assert.Equal(t, 400, segmentations[0].Score)
+	assert.Equal(t, "きょう、はれ", segmentations[0].Tokens.Kana())
+	assert.Equal(t, 300, segmentations[1].Score)
+	assert.Equal(t, "こんにち、はれ", segmentations[1].Tokens.Kana())
+
+	t.Run("n caps the number of segmentations", func(t *testing.T) {
+		segmentations, err := parseSegmentations([]byte(output), 1)
+		assert.NoError(t, err)
+		assert.Len(t, segmentations, 1)
+		assert.Equal(t, "きょう", segmentations[0].Tokens[0].Kana)
+	})
+}
+
+func TestParseAnalysisAlternatives(t *testing.T) {
+	output := `[[[[["kyō",{"alternative":[
+		{"type":"KANJI","reading":"今日 【きょう】","text":"今日","kana":"きょう","score":300,"seq":1579470,
+		 "gloss":[{"pos":"[n,adv]","gloss":"today"}],
+		 "conj":[{"prop":[{"pos":"n","type":"Non-past"}],"reading":"今日","readok":true}],
+		 "match":[{"kanji":"今日","reading":"きょう","type":"ja_kun","link":true}]},
+		{"reading":"今日 【こんにち】","text":"今日","kana":"こんにち","score":290,"seq":1579480,
+		 "gloss":[{"pos":"[n,adv]","gloss":"nowadays"}]}
+	]},[]]],300]]]`
+
+	tokens, err := parseAnalysis([]byte(output))
+	assert.NoError(t, err)
+	assert.Len(t, *tokens, 1)
+
+	token := (*tokens)[0]
+	assert.Len(t, token.Alternative, 2)
+
+	// The first alternative spearheads the token
+	assert.True(t, token.IsLexical)
+	assert.Equal(t, "今日", token.Surface)
+	assert.Equal(t, "きょう", token.Kana)
+	assert.Equal(t, "今日 【きょう】", token.Reading)
+	assert.Equal(t, "kyō", token.Romaji)
+	assert.Equal(t, 300, token.Score)
+	assert.Equal(t, []KanjiReading{{Kanji: "今日", Reading: "きょう", Type: "ja_kun", Link: true}}, token.KanjiReadings)
+
+	first := token.Alternative[0]
+	assert.Equal(t, []Gloss{{Pos: "[n,adv]", Gloss: "today"}}, first.Gloss)
+	assert.Len(t, first.Conj, 1)
+	assert.Equal(t, 1579470, first.Seq)
+
+	second := token.Alternative[1]
+	assert.True(t, second.IsLexical)
+	assert.Equal(t, "こんにち", second.Kana)
+	assert.Equal(t, 290, second.Score)
+
+	assert.Equal(t, []string{"今日 (ALT1: today | ALT2: nowadays)"}, tokens.GlossParts())
+}
+
+func TestParseAnalysisComponents(t *testing.T) {
+	output := `[[[[["benkyō shite",{"type":"KANJI","text":"勉強して","kana":"べんきょうして","score":800,
+		"compound":["勉強","して"],
+		"components":[
+			{"type":"KANJI","text":"勉強","kana":"べんきょう","romaji":"benkyō","score":400,"seq":1403740,
+			 "gloss":{"reading":"勉強 【べんきょう】","gloss":[{"pos":"[n,vs]","gloss":"study"}]},
+			 "match":[{"kanji":"勉","reading":"べん","type":"ja_on","link":true},{"kanji":"強","reading":"きょう","type":"ja_on","link":true}]},
+			{"type":"KANA","text":"して","kana":"して","romaji":"shite","score":0,"seq":1157170,
+			 "conj":[{"prop":[{"pos":"vs-i","type":"Conjunctive (~te)"}],"reading":"する","readok":true,
+			          "gloss":[{"pos":"[vs-i]","gloss":"to do"}]}]}
+		]},[]]],800]]]`
+
+	tokens, err := parseAnalysis([]byte(output))
+	assert.NoError(t, err)
+
+	token := (*tokens)[0]
+	assert.Equal(t, []string{"勉強", "して"}, token.Compound)
+	assert.Len(t, token.Components, 2)
+
+	morphemes := tokens.ToMorphemes()
+	assert.Len(t, morphemes, 2)
+
+	benkyo := morphemes[0]
+	assert.Equal(t, "benkyō", benkyo.Romaji)
+	assert.Equal(t, 1403740, benkyo.Seq)
+	assert.Equal(t, "勉強 【べんきょう】", benkyo.Reading)
+	assert.Len(t, benkyo.KanjiReadings, 2)
+
+	shite := morphemes[1]
+	assert.Equal(t, "shite", shite.Romaji)
+	assert.Len(t, shite.Conj, 1)
+	assert.Equal(t, "する", shite.Conj[0].Reading)
+	assert.Equal(t, "Conjunctive (~te)", shite.Conj[0].Prop[0].Type)
+	assert.Equal(t, []string{"to do"}, shite.getGlosses())
+
+	// Morphemes can be selectively transliterated
+	tlit, err := morphemes.SelectiveTranslit(3000)
+	assert.NoError(t, err)
+	assert.Equal(t, "勉強して", tlit)
+	tlit, err = morphemes.SelectiveTranslit(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "べんきょうして", tlit)
+}
+
+func TestParseAnalysisMixedText(t *testing.T) {
+	// "私は Tom 3.5kg、元気!\n": ichiran passes the text between Japanese fragments through
+	text := "私は Tom 3.5kg、元気!\n"
+	output := `[
+		[[[["watashi",{"type":"KANJI","text":"私","kana":"わたし"},[]],["wa",{"type":"KANA","text":"は","kana":"は"},[]]],100]],
+		" Tom 3.5kg、",
+		[[[["genki",{"type":"KANJI","text":"元気","kana":"げんき"},[]]],50]],
+		"!\n"
+	]`
+
+	tokens, err := parseAnalysis([]byte(output))
+	require.NoError(t, err)
+
+	var surfaces []string
+	var kinds []TokenKind
+	for _, token := range *tokens {
+		surfaces = append(surfaces, token.Surface)
+		kinds = append(kinds, token.Kind)
+		assert.Equal(t, token.Kind == TokenWord, token.IsLexical)
+	}
+	assert.Equal(t, []string{"私", "は", " ", "Tom", " ", "3.5", "kg", "、", "元気", "!", "\n"}, surfaces)
+	assert.Equal(t, []TokenKind{
+		TokenWord, TokenWord, TokenWhitespace, TokenLatin, TokenWhitespace, TokenNumber,
+		TokenLatin, TokenPunctuation, TokenWord, TokenPunctuation, TokenWhitespace,
+	}, kinds)
+
+	assert.Equal(t, "わたしは Tom 3.5kg、げんき!\n", tokens.Kana())
+	alignTokens(text, *tokens)
+	assert.NoError(t, tokens.VerifyOffsets(text))
+	assert.Empty(t, strings.Join(tokens.Gaps(text), ""), "whitespace is made of tokens, not gaps")
+}
+
+func TestTextTokens(t *testing.T) {
+	tests := []struct {
+		input string
+		kinds []TokenKind
+	}{
+		{"。", []TokenKind{TokenPunctuation}},
+		{"  \t", []TokenKind{TokenWhitespace}},
+		{"１２３", []TokenKind{TokenNumber}},
+		{"1,000.5", []TokenKind{TokenNumber}},
+		{"3.", []TokenKind{TokenNumber, TokenPunctuation}},
+		{"café", []TokenKind{TokenLatin}},
+		{"+♪", []TokenKind{TokenSymbol}},
+		{"ヶ", []TokenKind{TokenWord}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var kinds []TokenKind
+			var text string
+			for _, token := range textTokens(tt.input) {
+				kinds = append(kinds, token.Kind)
+				text += token.Surface
+			}
+			assert.Equal(t, tt.kinds, kinds)
+			assert.Equal(t, tt.input, text)
+		})
+	}
+}
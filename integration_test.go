@@ -1,7 +1,6 @@
 package ichiran
 
 import (
-	"os"
 	"testing"
 	"context"
 	"time"
@@ -198,21 +197,11 @@ func TestMultipleInstances(t *testing.T) {
 
 // TestFullPipelineIntegration tests the complete Japanese analysis pipeline
 func TestFullPipelineIntegration(t *testing.T) {
-	// Skip test if not in manual test mode
-	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
-		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
-	}
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Test text with a mix of kanji, punctuation, and a period
 	japaneseText := "躊躇、探求。"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Test all of the transformation APIs
 	t.Run("Basic Transformations", func(t *testing.T) {
@@ -306,7 +295,7 @@ func TestFullPipelineIntegration(t *testing.T) {
 		// Find index of comma
 		commaIndex := -1
 		for i, part := range tokenParts {
-			if part == "、" || part == ", " {
+			if part == "、" || part == "," {
 				commaIndex = i
 				break
 			}
@@ -321,7 +310,7 @@ func TestFullPipelineIntegration(t *testing.T) {
 		// Find index of period
 		periodIndex := -1
 		for i, part := range tokenParts {
-			if part == "。" || part == ". " {
+			if part == "。" || part == "." {
 				periodIndex = i
 				break
 			}
@@ -338,21 +327,11 @@ func TestFullPipelineIntegration(t *testing.T) {
 
 // TestKanjiReadings tests the kanji reading functionality
 func TestKanjiReadings(t *testing.T) {
-	// Skip test if not in manual test mode
-	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
-		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
-	}
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Test text with various kanji
 	japaneseText := "日本語の勉強"
 
 	// Analyze the text
-	tokensPtr, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	tokensPtr := analyzeFixture(t, japaneseText)
 
 	// Verify kanji readings are populated
 	t.Run("Kanji Reading Data", func(t *testing.T) {
@@ -397,25 +376,14 @@ func TestKanjiReadings(t *testing.T) {
 
 // TestAnalyzeWithOption tests the Analyze function with options
 func TestAnalyzeWithOption(t *testing.T) {
-	// Skip test if not in manual test mode
-	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
-		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
-	}
-
-	// Initialize Ichiran
-	err := Init()
-	require.NoError(t, err)
-
 	// Test text with kanji
 	japaneseText := "日本語"
 
 	// Compare results with and without options
-	defaultTokens, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	defaultTokens := analyzeFixture(t, japaneseText)
 
 	// With options (using same text for comparison since AnalyzeWithOptions doesn't exist yet)
-	optsTokens, err := Analyze(japaneseText)
-	require.NoError(t, err)
+	optsTokens := analyzeFixture(t, japaneseText)
 
 	// Results should be the same
 	assert.Equal(t, len(*defaultTokens), len(*optsTokens),
@@ -0,0 +1,87 @@
+package ichiran
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// queryIDEnv is set in the environment of the ichiran-cli processes started in
+// the main container so that those of a given query can be found and killed
+// when it is canceled: Docker offers no way to signal the process of an exec.
+const queryIDEnv = "GO_ICHIRAN_QUERY"
+
+// killTimeout bounds the time spent killing the processes of a canceled query
+var killTimeout = 10 * time.Second
+
+// killScript terminates the processes whose environment contains the variable
+// given as $1 (NAME=value), forcefully if they are still alive after a grace
+// period.
+const killScript = `find_pids() {
+	for f in /proc/[0-9]*/environ; do
+		if tr '\0' '\n' < "$f" 2>/dev/null | grep -qxF "$1"; then
+			p=${f#/proc/}
+			echo "${p%/environ}"
+		fi
+	done
+}
+pids=$(find_pids "$1")
+[ -z "$pids" ] && exit 0
+kill -TERM $pids 2>/dev/null
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	sleep 0.2
+	pids=$(find_pids "$1")
+	[ -z "$pids" ] && exit 0
+done
+kill -KILL $pids 2>/dev/null
+exit 0`
+
+// newQueryID returns a random identifier for the processes of a query
+func newQueryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// queryEnv returns the environment marking the processes of the query queryID
+func queryEnv(queryID string) []string {
+	return []string{queryIDEnv + "=" + queryID}
+}
+
+// killQuery terminates the processes of the query queryID in the main container,
+// running the kill script as user. Failures are only logged: the query has
+// already failed because of its context.
+func (im *IchiranManager) killQuery(user, queryID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+
+	client, err := im.docker.GetClient()
+	if err != nil {
+		Logger.Warn().Err(err).Msg("failed to get Docker client to kill canceled query")
+		return
+	}
+	exec, err := client.ContainerExecCreate(ctx, im.containerName, container.ExecOptions{
+		User:         user,
+		Cmd:          []string{"sh", "-c", killScript, "sh", queryEnv(queryID)[0]},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		Logger.Warn().Err(err).Msg("failed to create exec to kill canceled query")
+		return
+	}
+	resp, err := client.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{})
+	if err != nil {
+		Logger.Warn().Err(err).Msg("failed to attach to exec killing canceled query")
+		return
+	}
+	defer resp.Close()
+
+	// The script is done once its output is closed
+	io.Copy(io.Discard, resp.Reader)
+	Logger.Debug().Str("query", queryID).Msg("killed processes of canceled query")
+}
@@ -0,0 +1,113 @@
+package ichiran
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKillScript runs the kill script on the host, where it behaves as in the
+// container: only the processes of the given query are killed.
+func TestKillScript(t *testing.T) {
+	if _, err := os.Stat("/proc/self/environ"); err != nil {
+		t.Skip("the kill script requires /proc")
+	}
+
+	start := func(queryID string) *exec.Cmd {
+		cmd := exec.Command("sleep", "60")
+		cmd.Env = append(os.Environ(), queryEnv(queryID)...)
+		require.NoError(t, cmd.Start())
+		return cmd
+	}
+	canceled, other := newQueryID(), newQueryID()
+	target := start(canceled)
+	bystander := start(other)
+	defer bystander.Process.Kill()
+
+	out, err := exec.Command("sh", "-c", killScript, "sh", queryEnv(canceled)[0]).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(target.Wait(), &exitErr), "the process of the canceled query was killed")
+
+	exited := make(chan struct{})
+	go func() {
+		bystander.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		t.Fatal("the process of another query was killed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestCancelKillsProcess checks that no ichiran-cli process is left running in
+// the container after a query was canceled.
+func TestCancelKillsProcess(t *testing.T) {
+	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
+		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
+	}
+	ctx := context.Background()
+	manager, err := NewManager(ctx)
+	require.NoError(t, err)
+	require.NoError(t, manager.Init(ctx))
+	defer manager.Close()
+
+	queryCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	_, err = manager.Analyze(queryCtx, strings.Repeat("日本の科学者たちは、地球温暖化の影響で海水温が上昇していることに警鐘を鳴らしています。", 50))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// List the processes of all queries
+	client, err := manager.docker.GetClient()
+	require.NoError(t, err)
+	exec, err := client.ContainerExecCreate(ctx, manager.containerName, container.ExecOptions{
+		Cmd:          []string{"sh", "-c", "grep -l " + queryIDEnv + "= /proc/[0-9]*/environ; true"},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	require.NoError(t, err)
+	resp, err := client.ContainerExecAttach(ctx, exec.ID, container.ExecStartOptions{})
+	require.NoError(t, err)
+	defer resp.Close()
+	output, err := readDockerOutput(ctx, resp.Reader, nil)
+	require.NoError(t, err)
+	assert.Empty(t, string(output), "processes left running")
+}
+
+// TestCancelDuringAttachKillsProcess checks that the process of a query is
+// killed when the query is canceled while its exec is being attached, before
+// its output could be read.
+func TestCancelDuringAttachKillsProcess(t *testing.T) {
+	im := newIchiranManager(WithDataDir(t.TempDir()))
+	f := newFakeDocker(t, im)
+	f.images = map[string]string{ghcrImageMain: "sha256:main", ghcrImagePg: "sha256:pg"}
+	require.NoError(t, im.Init(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.attach = func(exec *fakeExec) error {
+		if exec.options.Cmd[0] == "bash" {
+			cancel()
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	}
+
+	_, err := im.execLisp(ctx, "(+ 1 2)")
+	require.Error(t, err)
+
+	require.Len(t, f.execs, 2, "the kill script was run")
+	query, kill := f.execs[0].options, f.execs[1].options
+	assert.Equal(t, []string{"sh", "-c", killScript, "sh", query.Env[0]}, kill.Cmd)
+	assert.Equal(t, im.containerName, f.execs[1].container)
+}
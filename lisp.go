@@ -0,0 +1,151 @@
+package ichiran
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lispPrelude loads jsown and teaches it how to serialize ichiran's word-info
+// objects, enriched with the glosses, the romanization and the kanji-kana
+// mappings of each word and, recursively, of each of its alternative
+// interpretations or of each of the components of a compound.
+// It must be evaluated once per ichiran-cli process before any analysis form.
+const lispPrelude = `(ql:quickload :jsown :silent t)
+
+    (defun go-ichiran-word-json (word-info)
+      (let* ((gloss-json (handler-case
+                            (ichiran::word-info-gloss-json word-info)
+                          (error (e) (declare (ignore e)) nil)))
+             (match-json (handler-case
+                            (ichiran/kanji:match-readings-json
+                              (slot-value word-info (quote ichiran/dict::text))
+                              (slot-value word-info (quote ichiran/dict::kana)))
+                          (error (e) (declare (ignore e)) nil)))
+             (romaji (handler-case
+                        (ichiran::romanize-word (slot-value word-info (quote ichiran/dict::kana)))
+                      (error (e) (declare (ignore e)) nil)))
+             ;; the interpretations of a word with alternatives are stored as its components
+             (alternative-p (handler-case
+                               (slot-value word-info (quote ichiran/dict::alternative))
+                             (error (e) (declare (ignore e)) nil)))
+             (components (handler-case
+                            (slot-value word-info (quote ichiran/dict::components))
+                          (error (e) (declare (ignore e)) nil)))
+
+             (word-json (ichiran::word-info-json word-info)))
+
+        (when gloss-json
+          (jsown:extend-js word-json ("gloss" gloss-json)))
+
+        (when match-json
+          (jsown:extend-js word-json ("match" match-json)))
+
+        (when (stringp romaji)
+          (jsown:extend-js word-json ("romaji" romaji)))
+
+        (when components
+          (if alternative-p
+              (jsown:extend-js word-json
+                ("alternative" (mapcar (function go-ichiran-word-json) components)))
+              (jsown:extend-js word-json
+                ("components" (mapcar (function go-ichiran-word-json) components)))))
+
+        word-json))
+
+    (defmethod jsown:to-json ((word-info ichiran/dict::word-info))
+      (jsown:to-json (go-ichiran-word-json word-info)))`
+
+// Markers framing the conversation with a persistent session, see sessionProgram.
+// They must not contain any ';' as cleanLispCode would treat it as a comment.
+const (
+	sessionReadyMarker = "<<ICHIRAN-SESSION-READY>>"
+	sessionBeginMarker = "<<ICHIRAN-BEGIN>>"
+	sessionEndMarker   = "<<ICHIRAN-END>>"
+	sessionErrorPrefix = "<<ICHIRAN-ERROR>>"
+)
+
+// lispString returns s as a Lisp string literal. Inside a Lisp string only the
+// double quote and the backslash are special: both are escaped by a backslash,
+// every other character (newlines included) stands for itself. Invalid UTF-8
+// sequences are replaced by U+FFFD as they can't be read back by SBCL anyway.
+func lispString(s string) string {
+	var b strings.Builder
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// analyzeForm returns the Lisp form that romanizes text and serializes the result to JSON.
+// limit is the number of segmentations ichiran returns for each fragment of text.
+func analyzeForm(text string, limit int) string {
+	return fmt.Sprintf(`(jsown:to-json (ichiran::romanize* %s :limit %d))`, lispString(text), limit)
+}
+
+// analyzeBatchForm returns the Lisp form that romanizes each of texts and
+// serializes the results to a JSON array aligned with texts. A text whose
+// analysis fails yields an {"error": "..."} object instead of aborting the batch.
+func analyzeBatchForm(texts []string) string {
+	literals := make([]string, len(texts))
+	for i, text := range texts {
+		literals[i] = lispString(text)
+	}
+	return fmt.Sprintf(`(jsown:to-json
+      (mapcar (lambda (text)
+                (handler-case (ichiran::romanize* text :limit 1)
+                  (error (e) (jsown:new-js ("error" (princ-to-string e))))))
+              (list %s)))`, strings.Join(literals, " "))
+}
+
+// oneShotProgram returns the code evaluated by a single ichiran-cli -e invocation:
+// the prelude followed by one form read from stdin, whose value is printed by
+// ichiran-cli. Passing the form out-of-band keeps user input away from the shell
+// and from the command line.
+func oneShotProgram() string {
+	return cleanLispCode(fmt.Sprintf(`(progn
+    %s
+
+    (eval (let ((*read-eval* nil))
+            (read *standard-input*))))`, lispPrelude))
+}
+
+// sessionProgram returns the code of a long-lived ichiran-cli process: after
+// evaluating the prelude once, it announces itself ready then reads forms from
+// stdin one at a time, printing each result between sessionBeginMarker and
+// sessionEndMarker. Lisp errors are reported on a single line prefixed by
+// sessionErrorPrefix instead of killing the process. EOF on stdin ends the loop.
+func sessionProgram() string {
+	return cleanLispCode(fmt.Sprintf(`(progn
+    %s
+
+    (format t "~%%~a~%%" "%s")
+    (finish-output)
+
+    (loop
+      (let ((form (let ((*read-eval* nil))
+                    (read *standard-input* nil :eof))))
+        (when (eq form :eof)
+          (return))
+        (let ((result (handler-case
+                          (list :ok (eval form))
+                        (error (e) (list :error (princ-to-string e))))))
+          (format t "~%%~a~%%" "%s")
+          (if (eq (first result) :ok)
+              (format t "~a~%%" (second result))
+              (format t "~a~a~%%" "%s"
+                      (substitute #\Space #\Newline (second result))))
+          (format t "~a~%%" "%s")
+          (finish-output)))))`,
+		lispPrelude,
+		sessionReadyMarker,
+		sessionBeginMarker,
+		sessionErrorPrefix,
+		sessionEndMarker))
+}
@@ -0,0 +1,118 @@
+package ichiran
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readLispString reads a Lisp string literal at the beginning of s the way the
+// Lisp reader does and returns its value along with the rest of s.
+func readLispString(s string) (value, rest string, err error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("not a string literal: %q", s)
+	}
+	var b strings.Builder
+	escaped := false
+	for i, r := range s[1:] {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			return b.String(), s[i+2:], nil
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string literal: %q", s)
+}
+
+func TestLispString(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "plain text",
+			input:    "こんにちは",
+			expected: `"こんにちは"`,
+		},
+		{
+			name:     "double quote",
+			input:    `彼は"はい"と言った`,
+			expected: `"彼は\"はい\"と言った"`,
+		},
+		{
+			name:     "backslash",
+			input:    `C:\dir`,
+			expected: `"C:\\dir"`,
+		},
+		{
+			name:     "apostrophe and parens are left as is",
+			input:    "it's (fine)",
+			expected: `"it's (fine)"`,
+		},
+		{
+			name:     "invalid utf-8",
+			input:    "a\xffb",
+			expected: "\"a\uFFFDb\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, lispString(tt.input))
+		})
+	}
+}
+
+func TestOneShotProgramIsConstant(t *testing.T) {
+	// User input never reaches the command line
+	assert.NotContains(t, oneShotProgram(), "romanize*")
+	assert.True(t, strings.HasPrefix(safe(oneShotProgram()), "'("))
+}
+
+// FuzzAnalyzeForm checks that whatever the input, the analysis form stays a
+// well-formed call whose string argument reads back as the input.
+func FuzzAnalyzeForm(f *testing.F) {
+	for _, seed := range []string{
+		"こんにちは",
+		`"`,
+		`\`,
+		`\"`,
+		`")) (sb-ext:exit) ("`,
+		"'; rm -rf / #",
+		"#.(sb-ext:run-program \"/bin/sh\" nil)",
+		"改行\nと\tタブ",
+		"\x00\xff",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	const prefix = "(jsown:to-json (ichiran::romanize* "
+	const suffix = " :limit 1))"
+
+	f.Fuzz(func(t *testing.T, text string) {
+		form := analyzeForm(text, 1)
+		require.True(t, strings.HasPrefix(form, prefix), form)
+
+		value, rest, err := readLispString(strings.TrimPrefix(form, prefix))
+		require.NoError(t, err)
+		assert.Equal(t, strings.ToValidUTF8(text, "\uFFFD"), value)
+		assert.Equal(t, suffix, rest)
+	})
+}
+
+func TestAnalyzeBatchForm(t *testing.T) {
+	form := analyzeBatchForm([]string{"今日は", `"quoted"`})
+	assert.Contains(t, form, `(list "今日は" "\"quoted\"")`)
+	assert.Contains(t, form, "handler-case")
+}
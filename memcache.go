@@ -0,0 +1,120 @@
+package ichiran
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultMemoryCacheSize is the number of analyses kept by WithMemoryCache when
+// no positive size is given
+var DefaultMemoryCacheSize = 1024
+
+// WithMemoryCache keeps the tokens of the last size texts given to Analyze in
+// memory (DefaultMemoryCacheSize if size isn't positive). Concurrent calls of
+// Analyze on the same text share a single query to ichiran. Callers always get
+// their own deep copy of the tokens: modifying them doesn't affect the cache.
+func WithMemoryCache(size int) ManagerOption {
+	return func(im *IchiranManager) {
+		if size <= 0 {
+			size = DefaultMemoryCacheSize
+		}
+		im.memory = newMemoryCache(size)
+	}
+}
+
+// memoryCache is an LRU cache of analyses that coalesces concurrent queries of
+// the same text
+type memoryCache struct {
+	size  int
+	group singleflight.Group
+
+	mu      sync.Mutex
+	order   *list.List               // of *memoryEntry, most recently used first
+	entries map[string]*list.Element // by text
+}
+
+type memoryEntry struct {
+	text   string
+	tokens JSONTokens
+}
+
+func newMemoryCache(size int) *memoryCache {
+	return &memoryCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// analyze returns a copy of the cached tokens of text or calls analyze to get
+// them, unless a call for the same text is already in progress, in which case
+// its result is shared.
+func (c *memoryCache) analyze(ctx context.Context, text string, analyze func(context.Context, string) (*JSONTokens, error)) (*JSONTokens, error) {
+	for {
+		if tokens, ok := c.get(text); ok {
+			return &tokens, nil
+		}
+
+		results := c.group.DoChan(text, func() (interface{}, error) {
+			tokens, err := analyze(ctx, text)
+			if err != nil {
+				return nil, err
+			}
+			c.add(text, *tokens)
+			return *tokens, nil
+		})
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-results:
+			if res.Err != nil {
+				// The shared call was canceled along with the context of the
+				// caller that made it: try again if ours is still alive
+				if res.Shared && ctx.Err() == nil && isContextError(res.Err) {
+					continue
+				}
+				return nil, res.Err
+			}
+			tokens := res.Val.(JSONTokens).clone()
+			return &tokens, nil
+		}
+	}
+}
+
+// get returns a copy of the cached tokens of text, if any
+func (c *memoryCache) get(text string) (JSONTokens, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[text]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).tokens.clone(), true
+}
+
+// add caches a copy of tokens as the analysis of text, evicting the least
+// recently used entry if the cache is full
+func (c *memoryCache) add(text string, tokens JSONTokens) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[text]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[text] = c.order.PushFront(&memoryEntry{text: text, tokens: tokens.clone()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryEntry).text)
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,89 @@
+package ichiran
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	command, dir := stubCLI(t, konnichihaJSON)
+	calls := func() int {
+		data, _ := os.ReadFile(filepath.Join(dir, "calls"))
+		return strings.Count(string(data), "\n")
+	}
+
+	manager, err := NewManager(ctx, WithNativeBackend(command), WithMemoryCache(0))
+	require.NoError(t, err)
+
+	t.Run("concurrent calls are coalesced", func(t *testing.T) {
+		const n = 8
+		results := make([]*JSONTokens, n)
+		var wg sync.WaitGroup
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tokens, err := manager.Analyze(ctx, "slow")
+				assert.NoError(t, err)
+				results[i] = tokens
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 1, calls())
+		for _, tokens := range results[1:] {
+			require.NotNil(t, tokens)
+			assert.Equal(t, results[0], tokens)
+			assert.NotSame(t, (*results[0])[0], (*tokens)[0], "each caller gets its own copy")
+		}
+	})
+
+	t.Run("results are deep copies", func(t *testing.T) {
+		tokens, err := manager.Analyze(ctx, "slow")
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls(), "served by the cache")
+
+		(*tokens)[0].Romaji = "corrupted"
+		(*tokens)[0].Gloss[0].Gloss = "corrupted"
+		*tokens = (*tokens)[:0]
+
+		tokens, err = manager.Analyze(ctx, "slow")
+		require.NoError(t, err)
+		assert.Equal(t, "konnichiha", (*tokens)[0].Romaji)
+		assert.NotEqual(t, "corrupted", (*tokens)[0].Gloss[0].Gloss)
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		_, err := manager.Analyze(ctx, "fail")
+		require.Error(t, err)
+		_, err = manager.Analyze(ctx, "fail")
+		require.Error(t, err)
+		assert.Equal(t, 3, calls())
+	})
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	cache := newMemoryCache(2)
+	var analyzed []string
+	analyze := func(ctx context.Context, text string) (*JSONTokens, error) {
+		analyzed = append(analyzed, text)
+		return &JSONTokens{{Surface: text}}, nil
+	}
+
+	for _, text := range []string{"a", "b", "a", "c", "a", "b"} {
+		tokens, err := cache.analyze(ctx, text, analyze)
+		require.NoError(t, err)
+		assert.Equal(t, text, (*tokens)[0].Surface)
+	}
+	// c evicted b, the least recently used, and not a
+	assert.Equal(t, []string{"a", "b", "c", "b"}, analyzed)
+}
@@ -0,0 +1,72 @@
+package ichiran
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DefaultNativeCommand is the ichiran-cli executable run by the native backend
+// when no path is given to WithNativeBackend
+var DefaultNativeCommand = "ichiran-cli"
+
+// WithNativeBackend makes the manager run ichiran-cli installed on the host
+// instead of the one of the Docker containers, which are then never created.
+// command is the path of the executable, DefaultNativeCommand (looked up in
+// PATH) if empty. The native backend doesn't support WithPersistentSession.
+func WithNativeBackend(command string) ManagerOption {
+	return func(im *IchiranManager) {
+		if command == "" {
+			command = DefaultNativeCommand
+		}
+		im.nativeCommand = command
+	}
+}
+
+// isNative reports whether the manager uses the native backend
+func (im *IchiranManager) isNative() bool {
+	return im.nativeCommand != ""
+}
+
+// checkNativeCommand makes sure the ichiran-cli of the native backend can be run
+func (im *IchiranManager) checkNativeCommand() error {
+	if _, err := exec.LookPath(im.nativeCommand); err != nil {
+		return fmt.Errorf("ichiran-cli not found for the native backend: %w", err)
+	}
+	return nil
+}
+
+// execNativeLisp runs a new ichiran-cli process on the host to evaluate form.
+// It shares the program and the stdin transport of execLisp.
+func (im *IchiranManager) execNativeLisp(ctx context.Context, form string) ([]byte, error) {
+	// No shell is involved: the program is passed as is
+	cmd := exec.CommandContext(ctx, im.nativeCommand, "-e", oneShotProgram())
+	cmd.Stdin = strings.NewReader(form)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, &ExecError{ExitCode: exitErr.ExitCode(), Stderr: string(bytes.TrimSpace(stderr.Bytes()))}
+		}
+		return nil, fmt.Errorf("failed to run %s: %w", im.nativeCommand, err)
+	}
+
+	if stderr.Len() > 0 {
+		Logger.Debug().Msgf("ichiran-cli stderr: %s", stderr.Bytes())
+	}
+
+	output, err := extractJSON(ctx, bytes.TrimSpace(stdout.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command output: %w", err)
+	}
+	return output, nil
+}
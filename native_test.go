@@ -0,0 +1,110 @@
+package ichiran
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubCLI writes a shell script standing in for ichiran-cli: it saves its
+// arguments and stdin next to it, then prints output to stdout. It fails with
+// "boom" on stderr when the form it reads contains "fail", hangs when it
+// contains "hang" and takes half a second when it contains "slow". Each run
+// appends a line to the "calls" file.
+func stubCLI(t *testing.T, output string) (command, dir string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub of ichiran-cli is a shell script")
+	}
+	dir = t.TempDir()
+	script := `#!/bin/sh
+dir=$(dirname "$0")
+printf '%s' "$1" > "$dir/flag"
+printf '%s' "$2" > "$dir/program"
+form=$(cat)
+printf '%s' "$form" > "$dir/form"
+echo >> "$dir/calls"
+case "$form" in
+	*fail*) echo "boom" >&2; exit 3 ;;
+	*hang*) exec sleep 60 ;;
+	*slow*) sleep 0.5 ;;
+esac
+echo "WARNING: some loading noise"
+cat <<'JSON'
+` + output + `
+JSON
+`
+	command = filepath.Join(dir, "ichiran-cli")
+	require.NoError(t, os.WriteFile(command, []byte(script), 0755))
+	return command, dir
+}
+
+func TestNativeBackend(t *testing.T) {
+	ctx := context.Background()
+	command, dir := stubCLI(t, konnichihaJSON)
+
+	manager, err := NewManager(ctx, WithNativeBackend(command))
+	require.NoError(t, err)
+	defer manager.Close()
+
+	require.NoError(t, manager.Init(ctx))
+	status, err := manager.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "native", status)
+
+	t.Run("analyze", func(t *testing.T) {
+		tokens, err := manager.Analyze(ctx, `こんにちは"`)
+		require.NoError(t, err)
+		assert.Equal(t, "konnichiha", (*tokens)[0].Romaji)
+
+		// Same program and stdin transport as the container path
+		flag, _ := os.ReadFile(filepath.Join(dir, "flag"))
+		program, _ := os.ReadFile(filepath.Join(dir, "program"))
+		form, _ := os.ReadFile(filepath.Join(dir, "form"))
+		assert.Equal(t, "-e", string(flag))
+		assert.Equal(t, oneShotProgram(), string(program))
+		assert.Equal(t, analyzeForm(`こんにちは"`, 1), string(form))
+	})
+
+	t.Run("command failure", func(t *testing.T) {
+		_, err := manager.Analyze(ctx, "fail")
+		assert.ErrorContains(t, err, "exit code 3: boom")
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := manager.Analyze(ctx, "hang")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 30*time.Second)
+	})
+}
+
+func TestNativeBackendErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("missing command", func(t *testing.T) {
+		manager, err := NewManager(ctx, WithNativeBackend(filepath.Join(t.TempDir(), "ichiran-cli")))
+		require.NoError(t, err)
+		assert.ErrorContains(t, manager.Init(ctx), "not found")
+	})
+
+	t.Run("no JSON", func(t *testing.T) {
+		command, _ := stubCLI(t, "nothing to see here")
+		manager, err := NewManager(ctx, WithNativeBackend(command))
+		require.NoError(t, err)
+		_, err = manager.Analyze(ctx, "こんにちは")
+		assert.ErrorIs(t, err, ErrNoJSON)
+	})
+
+	t.Run("persistent session", func(t *testing.T) {
+		_, err := NewManager(ctx, WithNativeBackend(""), WithPersistentSession())
+		assert.ErrorContains(t, err, "only supported by the Docker backend")
+	})
+}
@@ -0,0 +1,149 @@
+package ichiran
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// alignTokens sets the offsets of tokens, and recursively of their components
+// and alternatives, against text, the input they were analyzed from.
+//
+// Each token is searched for from the end of the previous one: whatever lies in
+// between (whitespace, which ichiran drops, or up to alignSlack runes of anything
+// else it ignored) is a gap. Should ichiran have altered a surface so that it
+// can't be found verbatim there, the token is marked Unaligned and assumed to
+// span as many runes as its surface right where the previous one ended. Either
+// way the spans are ordered and never overlap so that the input can always be
+// rebuilt from them and the gaps, see Gaps.
+func alignTokens(text string, tokens JSONTokens) {
+	var cursor, runeCursor int
+	for _, token := range tokens {
+		cursor, runeCursor = alignToken(text, cursor, runeCursor, len(text), token)
+	}
+}
+
+// alignSlack is the number of runes besides whitespace that ichiran may have
+// ignored before a token. Surfaces are only searched for that close to the end
+// of the previous token, so that a long input isn't scanned for each token and
+// an altered surface isn't matched by an occurrence further on.
+const alignSlack = 8
+
+// alignToken locates token in text[from:limit], runeFrom being the rune offset of
+// from, and returns the byte and rune offsets of its end.
+func alignToken(text string, from, runeFrom, limit int, token *JSONToken) (int, int) {
+	n := utf8.RuneCountInString(token.Surface)
+	window := skipRunes(text, skipSpaces(text, from, limit), limit, n+alignSlack)
+	start := from
+	var end int
+	if i := strings.Index(text[from:window], token.Surface); i >= 0 && token.Surface != "" {
+		start += i
+		end = start + len(token.Surface)
+		token.Unaligned = false
+	} else {
+		end = skipRunes(text, start, limit, n)
+		token.Unaligned = token.Surface != ""
+	}
+
+	token.StartByte, token.EndByte = start, end
+	token.Start = runeFrom + utf8.RuneCountInString(text[from:start])
+	token.End = token.Start + utf8.RuneCountInString(text[start:end])
+
+	// Components are found within the span of the compound
+	cursor, runeCursor := start, token.Start
+	for i := range token.Components {
+		cursor, runeCursor = alignToken(text, cursor, runeCursor, end, &token.Components[i])
+	}
+	// Alternatives are interpretations of the very same span
+	for i := range token.Alternative {
+		alignToken(text, start, token.Start, end, &token.Alternative[i])
+	}
+
+	return end, token.End
+}
+
+// skipSpaces returns the byte offset of the first rune of text[from:limit] that
+// isn't whitespace, limit if there is none
+func skipSpaces(text string, from, limit int) int {
+	for from < limit {
+		r, size := utf8.DecodeRuneInString(text[from:limit])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		from += size
+	}
+	return from
+}
+
+// skipRunes returns the byte offset n runes after from in text[:limit], at most limit
+func skipRunes(text string, from, limit, n int) int {
+	for ; n > 0 && from < limit; n-- {
+		_, size := utf8.DecodeRuneInString(text[from:limit])
+		from += size
+	}
+	return from
+}
+
+// shift moves the offsets of token, and recursively of its components and
+// alternatives, by bytes and runes, e.g. to make them relative to a larger text
+// than the one it was analyzed from.
+func (token *JSONToken) shift(bytes, runes int) {
+	token.StartByte += bytes
+	token.EndByte += bytes
+	token.Start += runes
+	token.End += runes
+	for i := range token.Components {
+		token.Components[i].shift(bytes, runes)
+	}
+	for i := range token.Alternative {
+		token.Alternative[i].shift(bytes, runes)
+	}
+}
+
+// Gaps returns the parts of text, the input tokens were analyzed from, found
+// before each token and, as the last element, after the last token: len(tokens)+1
+// strings, possibly empty. Interleaving them with the surfaces of the tokens
+// gives back text, as checked by VerifyOffsets.
+func (tokens JSONTokens) Gaps(text string) []string {
+	gaps := make([]string, 0, len(tokens)+1)
+	var cursor int
+	for _, token := range tokens {
+		start := min(max(token.StartByte, cursor), len(text))
+		gaps = append(gaps, text[cursor:start])
+		cursor = min(max(token.EndByte, start), len(text))
+	}
+	return append(gaps, text[cursor:])
+}
+
+// VerifyOffsets checks that the offsets of tokens are consistent with text, the
+// input they were analyzed from: spans are ordered, within text, and
+// concatenating the gaps and the surfaces of the tokens reproduces text exactly.
+func (tokens JSONTokens) VerifyOffsets(text string) error {
+	var cursor int
+	for i, token := range tokens {
+		if token.StartByte < cursor || token.EndByte < token.StartByte || token.EndByte > len(text) {
+			return fmt.Errorf("token #%d %q has invalid byte offsets [%d, %d)", i, token.Surface, token.StartByte, token.EndByte)
+		}
+		if token.Start != utf8.RuneCountInString(text[:token.StartByte]) ||
+			token.End-token.Start != utf8.RuneCountInString(text[token.StartByte:token.EndByte]) {
+			return fmt.Errorf("token #%d %q has rune offsets [%d, %d) inconsistent with its byte offsets", i, token.Surface, token.Start, token.End)
+		}
+		if span := text[token.StartByte:token.EndByte]; span != token.Surface {
+			return fmt.Errorf("token #%d has surface %q but spans %q of the input", i, token.Surface, span)
+		}
+		cursor = token.EndByte
+	}
+
+	var b strings.Builder
+	for i, gap := range tokens.Gaps(text) {
+		b.WriteString(gap)
+		if i < len(tokens) {
+			b.WriteString(tokens[i].Surface)
+		}
+	}
+	if b.String() != text {
+		return fmt.Errorf("tokens and gaps don't reproduce the input")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package ichiran
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tokensOf(surfaces ...string) JSONTokens {
+	var tokens JSONTokens
+	for _, surface := range surfaces {
+		tokens = append(tokens, &JSONToken{Surface: surface, IsLexical: true})
+	}
+	return tokens
+}
+
+func TestAlignTokens(t *testing.T) {
+	t.Run("whitespace gaps", func(t *testing.T) {
+		text := "  私は 日本語を　勉強しています。\n"
+		tokens := tokensOf("私", "は", "日本語", "を", "勉強しています", "。")
+		alignTokens(text, tokens)
+
+		require.NoError(t, tokens.VerifyOffsets(text))
+		assert.Equal(t, []string{"  ", "", " ", "", "　", "", "\n"}, tokens.Gaps(text))
+
+		assert.Equal(t, 2, tokens[0].Start)
+		assert.Equal(t, 3, tokens[0].End)
+		assert.Equal(t, 2, tokens[0].StartByte)
+		assert.Equal(t, 5, tokens[0].EndByte)
+		assert.Equal(t, 5, tokens[2].Start)
+		assert.Equal(t, 8, tokens[2].End)
+		for _, token := range tokens {
+			assert.Equal(t, token.Surface, text[token.StartByte:token.EndByte])
+			assert.Equal(t, token.Surface, string([]rune(text)[token.Start:token.End]))
+		}
+	})
+
+	t.Run("repeated surfaces", func(t *testing.T) {
+		text := "はは は"
+		tokens := tokensOf("は", "は", "は")
+		alignTokens(text, tokens)
+
+		require.NoError(t, tokens.VerifyOffsets(text))
+		assert.Equal(t, []int{0, 1, 3}, []int{tokens[0].Start, tokens[1].Start, tokens[2].Start})
+	})
+
+	t.Run("components and alternatives", func(t *testing.T) {
+		text := "ええ、勉強して"
+		tokens := tokensOf("ええ", "勉強して")
+		tokens[1].Components = []JSONToken{{Surface: "勉強"}, {Surface: "して"}}
+		tokens[1].Alternative = []JSONToken{{Surface: "勉強して"}}
+		alignTokens(text, tokens)
+
+		require.NoError(t, tokens.VerifyOffsets(text))
+		assert.Equal(t, 3, tokens[1].Components[0].Start)
+		assert.Equal(t, 5, tokens[1].Components[0].End)
+		assert.Equal(t, 5, tokens[1].Components[1].Start)
+		assert.Equal(t, 7, tokens[1].Components[1].End)
+		assert.Equal(t, 15, tokens[1].Components[1].StartByte)
+		assert.Equal(t, 3, tokens[1].Alternative[0].Start)
+		assert.Equal(t, 7, tokens[1].Alternative[0].End)
+	})
+
+	t.Run("altered surface", func(t *testing.T) {
+		// ichiran normalizes some characters, e.g. half-width digits
+		text := "１日 目"
+		tokens := tokensOf("1日", "目")
+		alignTokens(text, tokens)
+
+		assert.Equal(t, 0, tokens[0].Start)
+		assert.Equal(t, 2, tokens[0].End)
+		assert.True(t, tokens[0].Unaligned)
+		assert.Equal(t, 3, tokens[1].Start)
+		assert.False(t, tokens[1].Unaligned)
+		assert.Error(t, tokens.VerifyOffsets(text))
+
+		// The input can still be rebuilt from the spans and the gaps
+		var b strings.Builder
+		for i, gap := range tokens.Gaps(text) {
+			b.WriteString(gap)
+			if i < len(tokens) {
+				b.WriteString(text[tokens[i].StartByte:tokens[i].EndByte])
+			}
+		}
+		assert.Equal(t, text, b.String())
+	})
+
+	t.Run("altered surface found further on", func(t *testing.T) {
+		filler := strings.Repeat("あ", 2*alignSlack)
+		text := "１日、" + filler + "1日"
+		tokens := tokensOf("1日", "、", filler, "1日")
+		alignTokens(text, tokens)
+
+		assert.True(t, tokens[0].Unaligned)
+		assert.Equal(t, 0, tokens[0].Start)
+		assert.Equal(t, 2, tokens[0].End)
+		for _, token := range tokens[1:] {
+			assert.False(t, token.Unaligned)
+			assert.Equal(t, token.Surface, text[token.StartByte:token.EndByte])
+		}
+		assert.Equal(t, 3+2*alignSlack, tokens[3].Start)
+	})
+}
+
+func TestVerifyOffsets(t *testing.T) {
+	text := "今日は"
+	tokens := tokensOf("今日", "は")
+	alignTokens(text, tokens)
+	require.NoError(t, tokens.VerifyOffsets(text))
+
+	tokens[1].StartByte, tokens[1].EndByte = 3, 6
+	assert.ErrorContains(t, tokens.VerifyOffsets(text), "invalid byte offsets")
+
+	alignTokens(text, tokens)
+	tokens[1].Start = 1
+	assert.ErrorContains(t, tokens.VerifyOffsets(text), "inconsistent")
+
+	alignTokens(text, tokens)
+	assert.NoError(t, tokens.VerifyOffsets("今日は。"), "trailing text is a gap")
+	assert.ErrorContains(t, tokens.VerifyOffsets("今日が"), `spans "が"`)
+}
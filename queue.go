@@ -0,0 +1,156 @@
+package ichiran
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// Priority orders the queries waiting for a slot when the number of concurrent
+// queries is limited, see WithMaxConcurrency and WithPriority
+type Priority int
+
+const (
+	PriorityBackground  Priority = -1 // Batch jobs that can wait
+	PriorityNormal      Priority = 0  // Default priority of queries
+	PriorityInteractive Priority = 1  // Queries a user is waiting for
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose queries are served according to priority
+// when they have to wait for a slot: queries of higher priority go first, those
+// of equal priority are served in order of arrival.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityOf returns the priority of the queries made with ctx
+func priorityOf(ctx context.Context) Priority {
+	priority, _ := ctx.Value(priorityKey{}).(Priority)
+	return priority
+}
+
+// WithMaxConcurrency limits the number of queries sent to ichiran at once to n,
+// to avoid overloading the containers and Postgres. Queries beyond that wait in
+// a queue, ordered by priority, until a slot is free or their context is done.
+// The default, 0, means no limit.
+func WithMaxConcurrency(n int) ManagerOption {
+	return func(im *IchiranManager) {
+		if n > 0 {
+			im.limiter = newLimiter(n)
+		} else {
+			im.limiter = nil
+		}
+	}
+}
+
+// QueueLength returns the number of queries waiting for a slot, see WithMaxConcurrency
+func (im *IchiranManager) QueueLength() int {
+	if im.limiter == nil {
+		return 0
+	}
+	return im.limiter.queueLength()
+}
+
+// limiter hands out a limited number of slots, in order of priority then of arrival
+type limiter struct {
+	mu      sync.Mutex
+	max     int
+	running int
+	waiting waitQueue
+	arrival uint64
+}
+
+// waiter is a query waiting for a slot. ready is closed once it got it.
+type waiter struct {
+	priority Priority
+	arrival  uint64
+	ready    chan struct{}
+	index    int
+}
+
+func newLimiter(max int) *limiter {
+	return &limiter{max: max}
+}
+
+// acquire waits for a slot, which must be given back with release, or for ctx to be done
+func (l *limiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.running < l.max && len(l.waiting) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	l.arrival++
+	w := &waiter{priority: priorityOf(ctx), arrival: l.arrival, ready: make(chan struct{})}
+	heap.Push(&l.waiting, w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		select {
+		case <-w.ready:
+			// Got the slot while giving up: hand it to the next one
+			l.mu.Unlock()
+			l.release()
+		default:
+			heap.Remove(&l.waiting, w.index)
+			l.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// release gives back a slot obtained with acquire
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		// The slot goes straight to the next waiter
+		close(heap.Pop(&l.waiting).(*waiter).ready)
+		return
+	}
+	l.running--
+}
+
+func (l *limiter) queueLength() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiting)
+}
+
+// waitQueue implements heap.Interface, the first waiter to serve on top
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].arrival < q[j].arrival
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return w
+}
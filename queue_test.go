@@ -0,0 +1,87 @@
+package ichiran
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterPriority(t *testing.T) {
+	ctx := context.Background()
+	l := newLimiter(1)
+	require.NoError(t, l.acquire(ctx))
+
+	var (
+		mu     sync.Mutex
+		served []string
+		wg     sync.WaitGroup
+	)
+	queue := func(name string, priority Priority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, l.acquire(WithPriority(ctx, priority)))
+			mu.Lock()
+			served = append(served, name)
+			mu.Unlock()
+			l.release()
+		}()
+	}
+	waitQueued := func(n int) {
+		require.Eventually(t, func() bool { return l.queueLength() == n }, time.Second, time.Millisecond)
+	}
+
+	queue("batch", PriorityBackground)
+	waitQueued(1)
+	queue("normal 1", PriorityNormal)
+	waitQueued(2)
+	queue("normal 2", PriorityNormal)
+	waitQueued(3)
+	queue("user", PriorityInteractive)
+	waitQueued(4)
+
+	l.release()
+	wg.Wait()
+	assert.Equal(t, []string{"user", "normal 1", "normal 2", "batch"}, served)
+	assert.Equal(t, 0, l.running)
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := newLimiter(1)
+	require.NoError(t, l.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.acquire(ctx), context.DeadlineExceeded)
+	assert.Equal(t, 0, l.queueLength())
+
+	// The slot is free again once released
+	l.release()
+	require.NoError(t, l.acquire(context.Background()))
+	l.release()
+	assert.Equal(t, 0, l.running)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	ctx := context.Background()
+	command, _ := stubCLI(t, konnichihaJSON)
+	manager, err := NewManager(ctx, WithNativeBackend(command), WithMaxConcurrency(1))
+	require.NoError(t, err)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, text := range []string{"slow 1", "slow 2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := manager.Analyze(ctx, text)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "queries ran one after the other")
+}
@@ -0,0 +1,104 @@
+package ichiran
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoRecording is returned in replay mode for a query that wasn't recorded
+var ErrNoRecording = errors.New("no recorded ichiran output for this query")
+
+// SnippetVersion identifies the Lisp code that makes ichiran output JSON: outputs
+// recorded or cached with another version may not be parsed the same way.
+var SnippetVersion = func() string {
+	sum := sha256.Sum256([]byte(lispPrelude))
+	return hex.EncodeToString(sum[:8])
+}()
+
+// WithRecording makes the manager save the JSON output of each successful query
+// to dir, so that it can be replayed later by WithReplay.
+func WithRecording(dir string) ManagerOption {
+	return func(im *IchiranManager) {
+		im.recordDir = dir
+	}
+}
+
+// WithReplay makes the manager answer queries with the outputs recorded in dir
+// by WithRecording instead of running ichiran: no container is needed. Queries
+// that weren't recorded fail with ErrNoRecording.
+func WithReplay(dir string) ManagerOption {
+	return func(im *IchiranManager) {
+		im.replayDir = dir
+	}
+}
+
+// recording is the content of a file written by WithRecording
+type recording struct {
+	SnippetVersion string          `json:"snippet_version"`
+	Form           string          `json:"form"`   // Analysis form, which holds the input text
+	Output         json.RawMessage `json:"output"` // JSON produced by ichiran
+}
+
+// recordingPath returns the path of the recording of form in dir: the name of the
+// file is a hash of the form (i.e. of the input text and of the kind of query)
+// and of SnippetVersion.
+func recordingPath(dir, form string) string {
+	sum := sha256.Sum256([]byte(SnippetVersion + "\n" + form))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// saveRecording saves output as the JSON produced by ichiran for form
+func saveRecording(dir, form string, output []byte) error {
+	// Neither indented nor HTML-escaped: the output must be replayed byte for byte
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(recording{
+		SnippetVersion: SnippetVersion,
+		Form:           form,
+		Output:         output,
+	}); err != nil {
+		return fmt.Errorf("failed to encode recording: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	// A replay never reads a partial recording
+	err := writeFileAtomic(recordingPath(dir, form), func(w io.Writer) error {
+		_, err := data.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+// loadRecording returns the JSON recorded in dir for form
+func loadRecording(dir, form string) ([]byte, error) {
+	data, err := os.ReadFile(recordingPath(dir, form))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNoRecording, stringCapLen(form, 200))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	var rec recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode recording: %w", err)
+	}
+	// Hash collisions are not a concern but hand-edited recordings are
+	if rec.Form != form || rec.SnippetVersion != SnippetVersion {
+		return nil, fmt.Errorf("%w: recording %s is for another query", ErrNoRecording, recordingPath(dir, form))
+	}
+	return rec.Output, nil
+}
@@ -0,0 +1,74 @@
+package ichiran
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Record a live session, with the stub of ichiran-cli as the live backend
+	command, _ := stubCLI(t, strings.Replace(konnichihaJSON, "good day", "good <day> & night", 1))
+	recorder, err := NewManager(ctx, WithNativeBackend(command), WithRecording(dir))
+	require.NoError(t, err)
+
+	recorded, err := recorder.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	_, err = recorder.AnalyzeNBest(ctx, "こんにちは", 2)
+	require.NoError(t, err)
+	_, err = recorder.Analyze(ctx, "fail")
+	require.Error(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2, "one recording per successful query")
+
+	// Replay it without any backend
+	replayer, err := NewManager(ctx, WithReplay(dir))
+	require.NoError(t, err)
+	require.NoError(t, replayer.Init(ctx))
+	status, err := replayer.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "replay", status)
+
+	replayed, err := replayer.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	assert.Equal(t, recorded, replayed)
+
+	segmentations, err := replayer.AnalyzeNBest(ctx, "こんにちは", 2)
+	require.NoError(t, err)
+	assert.Equal(t, "konnichiha", segmentations[0].Tokens[0].Romaji)
+
+	t.Run("not recorded", func(t *testing.T) {
+		_, err := replayer.Analyze(ctx, "さようなら")
+		assert.ErrorIs(t, err, ErrNoRecording)
+		_, err = replayer.AnalyzeNBest(ctx, "こんにちは", 3)
+		assert.ErrorIs(t, err, ErrNoRecording)
+	})
+
+	t.Run("recording of another snippet version", func(t *testing.T) {
+		form := analyzeForm("さようなら", 1)
+		require.NoError(t, saveRecording(dir, form, []byte(konnichihaJSON)))
+		data, err := os.ReadFile(recordingPath(dir, form))
+		require.NoError(t, err)
+		data = []byte(strings.Replace(string(data), SnippetVersion, "0000000000000000", 1))
+		require.NoError(t, os.WriteFile(recordingPath(dir, form), data, 0644))
+
+		_, err = replayer.Analyze(ctx, "さようなら")
+		assert.ErrorIs(t, err, ErrNoRecording)
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		manager, err := NewManager(ctx, WithReplay(filepath.Join(dir, "missing")))
+		require.NoError(t, err)
+		assert.Error(t, manager.Init(ctx))
+	})
+}
@@ -0,0 +1,173 @@
+package ichiran
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// RecoveryPolicy tells how a manager recovers from the death of its containers,
+// see WithRecovery
+type RecoveryPolicy struct {
+	MaxRetries     int           // Number of times a failed query is retried
+	InitialBackoff time.Duration // Wait before the first retry, doubled for each of the next ones
+	MaxBackoff     time.Duration // Upper bound of the wait between retries
+}
+
+// DefaultRecoveryPolicy is the policy used by WithRecovery for fields left to zero
+var DefaultRecoveryPolicy = RecoveryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// WithRecovery makes the manager heal itself when its containers die: when a
+// query fails while the main or the pg container isn't running (or is
+// unhealthy), the containers are restarted, the manager waits until ichiran is
+// ready again and the query is retried with exponential backoff. Queries only
+// read the database so retrying them is always safe.
+func WithRecovery(policy RecoveryPolicy) ManagerOption {
+	return func(im *IchiranManager) {
+		if policy.MaxRetries == 0 {
+			policy.MaxRetries = DefaultRecoveryPolicy.MaxRetries
+		}
+		if policy.InitialBackoff == 0 {
+			policy.InitialBackoff = DefaultRecoveryPolicy.InitialBackoff
+		}
+		if policy.MaxBackoff == 0 {
+			policy.MaxBackoff = DefaultRecoveryPolicy.MaxBackoff
+		}
+		im.recovery = &policy
+	}
+}
+
+// evalLispRecovering evaluates form like evalLispOnce, recovering from the
+// death of the containers according to the recovery policy
+func (im *IchiranManager) evalLispRecovering(ctx context.Context, form string) ([]byte, error) {
+	return retryWithRecovery(ctx, *im.recovery,
+		func() ([]byte, error) { return im.evalLispOnce(ctx, form) },
+		im.containersHealthy,
+		im.recoverContainers,
+	)
+}
+
+// retryWithRecovery calls attempt until it succeeds or policy.MaxRetries retries
+// failed. A failure is only retried if the containers aren't healthy, as
+// reported by healthy, in which case they are restored with restore first.
+func retryWithRecovery(ctx context.Context, policy RecoveryPolicy, attempt func() ([]byte, error),
+	healthy func(context.Context) error, restore func(context.Context) error) ([]byte, error) {
+	backoff := policy.InitialBackoff
+	for retry := 0; ; retry++ {
+		output, err := attempt()
+		if err == nil || ctx.Err() != nil || retry >= policy.MaxRetries {
+			return output, err
+		}
+		// Failures of healthy containers are due to the query itself
+		healthErr := healthy(ctx)
+		if healthErr == nil && !errors.Is(err, ErrContainerNotRunning) {
+			return nil, err
+		}
+		Logger.Warn().Err(err).AnErr("health", healthErr).
+			Msgf("query failed with unhealthy containers, recovering (%d/%d)", retry+1, policy.MaxRetries)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
+
+		if err := restore(ctx); err != nil {
+			// Retry anyway: the next failure will trigger another recovery
+			Logger.Warn().Err(err).Msg("failed to recover containers")
+		}
+	}
+}
+
+// containersHealthy returns an error telling why the main or the pg container
+// can't serve queries, nil if both can
+func (im *IchiranManager) containersHealthy(ctx context.Context) error {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	for _, name := range []string{im.containerName, im.pgContainerName()} {
+		containerInfo, err := client.ContainerInspect(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+		if !containerInfo.State.Running {
+			return fmt.Errorf("%w: %s", ErrContainerNotRunning, name)
+		}
+		if health := containerInfo.State.Health; health != nil && health.Status == "unhealthy" {
+			return fmt.Errorf("container %s is unhealthy", name)
+		}
+	}
+	return nil
+}
+
+// maintenanceWeight is the weight of stackSem taken by withoutRecovery: all of
+// it, while each query takes 1
+const maintenanceWeight = math.MaxInt32
+
+// withoutRecovery runs fn while keeping the recovery from restarting the
+// containers, for the operations that stop them or replace their data on
+// purpose. It waits for the queries in flight and makes the next ones wait
+// until fn returns, as fn may replace the Docker manager and its client.
+func (im *IchiranManager) withoutRecovery(ctx context.Context, fn func() error) error {
+	if err := im.stackSem.Acquire(ctx, maintenanceWeight); err != nil {
+		return err
+	}
+	defer im.stackSem.Release(maintenanceWeight)
+	if err := im.lockRecovery(ctx); err != nil {
+		return err
+	}
+	defer im.unlockRecovery()
+	return fn()
+}
+
+// lockRecovery takes the lock shared by the recovery and the operations of
+// withoutRecovery, which may hold it for long, giving up when ctx is done
+func (im *IchiranManager) lockRecovery(ctx context.Context) error {
+	select {
+	case im.recoverySem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (im *IchiranManager) unlockRecovery() {
+	<-im.recoverySem
+}
+
+// recoverContainers restarts the containers and waits until ichiran is ready
+// again. Concurrent queries that failed share a single restart. It gives up
+// when ctx is done before the containers could be restarted, e.g. while an
+// Upgrade holds them.
+func (im *IchiranManager) recoverContainers(ctx context.Context) error {
+	if err := im.lockRecovery(ctx); err != nil {
+		return fmt.Errorf("recovery canceled while waiting for maintenance: %w", err)
+	}
+	defer im.unlockRecovery()
+	if im.containersHealthy(ctx) == nil {
+		// Another query already took care of it
+		return nil
+	}
+
+	im.closeSession()
+	im.resetBackendVersion()
+	// Init skips projects that are still partly running: stop everything so
+	// that all containers are started again, then wait for the readiness
+	// message of ichiran
+	if err := im.docker.Stop(); err != nil {
+		Logger.Debug().Err(err).Msg("failed to stop containers before recovery")
+	}
+	if err := im.docker.InitQuiet(); err != nil {
+		return fmt.Errorf("failed to restart containers: %w", err)
+	}
+	Logger.Info().Msg("ichiran containers recovered")
+	return nil
+}
@@ -0,0 +1,153 @@
+package ichiran
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryWithRecovery(t *testing.T) {
+	ctx := context.Background()
+	policy := RecoveryPolicy{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	// containers simulates containers that die and are restored
+	type containers struct {
+		running  bool
+		attempts int
+		restores int
+	}
+	attempt := func(c *containers) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			c.attempts++
+			if !c.running {
+				return nil, ErrContainerNotRunning
+			}
+			return []byte("[]"), nil
+		}
+	}
+	healthy := func(c *containers) func(context.Context) error {
+		return func(context.Context) error {
+			if !c.running {
+				return ErrContainerNotRunning
+			}
+			return nil
+		}
+	}
+	restore := func(c *containers, err error) func(context.Context) error {
+		return func(context.Context) error {
+			c.restores++
+			if err != nil {
+				return err
+			}
+			c.running = true
+			return nil
+		}
+	}
+
+	t.Run("recovered", func(t *testing.T) {
+		c := &containers{}
+		output, err := retryWithRecovery(ctx, policy, attempt(c), healthy(c), restore(c, nil))
+		require.NoError(t, err)
+		assert.Equal(t, "[]", string(output))
+		assert.Equal(t, 2, c.attempts)
+		assert.Equal(t, 1, c.restores)
+	})
+
+	t.Run("recovery keeps failing", func(t *testing.T) {
+		c := &containers{}
+		_, err := retryWithRecovery(ctx, policy, attempt(c), healthy(c), restore(c, errors.New("no space left")))
+		assert.ErrorIs(t, err, ErrContainerNotRunning)
+		assert.Equal(t, 4, c.attempts, "the query and its retries")
+		assert.Equal(t, 3, c.restores)
+	})
+
+	t.Run("failure of healthy containers", func(t *testing.T) {
+		c := &containers{running: true}
+		failing := func() ([]byte, error) {
+			c.attempts++
+			return nil, &ExecError{ExitCode: 1, Stderr: "bad input"}
+		}
+		_, err := retryWithRecovery(ctx, policy, failing, healthy(c), restore(c, nil))
+		var execErr *ExecError
+		assert.ErrorAs(t, err, &execErr)
+		assert.Equal(t, 1, c.attempts, "not retried")
+		assert.Equal(t, 0, c.restores)
+	})
+
+	t.Run("canceled during backoff", func(t *testing.T) {
+		c := &containers{}
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		slow := RecoveryPolicy{MaxRetries: 3, InitialBackoff: time.Minute, MaxBackoff: time.Minute}
+		_, err := retryWithRecovery(ctx, slow, attempt(c), healthy(c), restore(c, nil))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 0, c.restores)
+	})
+}
+
+func TestWithRecoveryDefaults(t *testing.T) {
+	im := &IchiranManager{}
+	WithRecovery(RecoveryPolicy{MaxRetries: 5})(im)
+	require.NotNil(t, im.recovery)
+	assert.Equal(t, 5, im.recovery.MaxRetries)
+	assert.Equal(t, DefaultRecoveryPolicy.InitialBackoff, im.recovery.InitialBackoff)
+	assert.Equal(t, DefaultRecoveryPolicy.MaxBackoff, im.recovery.MaxBackoff)
+}
+
+// TestRecoveryAfterContainerDeath stops the pg container behind the manager's
+// back and checks that the next query still succeeds.
+func TestRecoveryAfterContainerDeath(t *testing.T) {
+	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
+		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
+	}
+	ctx := context.Background()
+	manager, err := NewManager(ctx, WithRecovery(RecoveryPolicy{}))
+	require.NoError(t, err)
+	require.NoError(t, manager.Init(ctx))
+	defer manager.Close()
+
+	client, err := manager.docker.GetClient()
+	require.NoError(t, err)
+	require.NoError(t, client.ContainerStop(ctx, manager.pgContainerName(), container.StopOptions{}))
+
+	tokens, err := manager.Analyze(ctx, "こんにちは")
+	require.NoError(t, err)
+	assert.Equal(t, "konnichiha", (*tokens)[0].Romaji)
+	assert.NoError(t, manager.containersHealthy(ctx))
+}
+
+// TestRecoveryDuringMaintenance checks that a query failing while maintenance
+// holds the containers gives up at its deadline instead of waiting for it.
+func TestRecoveryDuringMaintenance(t *testing.T) {
+	ctx := context.Background()
+	im := newIchiranManager(WithDataDir(t.TempDir()),
+		WithRecovery(RecoveryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	im.QueryTimeout = 200 * time.Millisecond
+	f := newFakeDocker(t, im)
+
+	holding, release := make(chan struct{}), make(chan struct{})
+	maintenance := make(chan error)
+	go func() {
+		maintenance <- im.withoutRecovery(ctx, func() error {
+			close(holding)
+			<-release
+			return nil
+		})
+	}()
+	<-holding
+
+	start := time.Now()
+	_, err := im.Analyze(ctx, "こんにちは")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.NotContains(t, f.takeEvents(), "init", "the containers are left to the maintenance")
+
+	close(release)
+	require.NoError(t, <-maintenance)
+}
@@ -0,0 +1,109 @@
+package ichiran
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPostgresPassword is the password of the postgres user when neither
+// WithPostgresPassword nor WithGeneratedPostgresPassword is used, and no
+// generated password was persisted in the data directory by a previous run
+const DefaultPostgresPassword = "password"
+
+// postgresPasswordFile is the file of the data directory holding the generated
+// Postgres password
+const postgresPasswordFile = "secrets/postgres-password"
+
+// WithPostgresPassword sets the password of the postgres user. It is passed to
+// both containers in the POSTGRES_PASSWORD environment variable, which the stock
+// main image ignores: anything but DefaultPostgresPassword requires a main image
+// reading it from there, set with WithImages, or NewManager fails. Postgres only
+// applies it when it initializes pgdata, so changing the password of an
+// existing install requires a fresh data directory.
+func WithPostgresPassword(password string) ManagerOption {
+	return func(im *IchiranManager) {
+		im.postgresPassword = password
+	}
+}
+
+// WithGeneratedPostgresPassword makes the manager generate a random password
+// for the postgres user on the first run and persist it in the data directory,
+// readable by its owner only. Later runs reuse it, with or without this option.
+// Like WithPostgresPassword, it requires a custom main image.
+func WithGeneratedPostgresPassword() ManagerOption {
+	return func(im *IchiranManager) {
+		im.generatePassword = true
+	}
+}
+
+// resolvePostgresPassword settles the password of the postgres user: the one
+// given to WithPostgresPassword, else the persisted one, else a newly generated
+// one if asked to, else DefaultPostgresPassword
+func (im *IchiranManager) resolvePostgresPassword() error {
+	if im.postgresPassword != "" {
+		return im.checkPostgresPassword()
+	}
+	path := filepath.Join(im.dataDir(), postgresPasswordFile)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		im.postgresPassword = strings.TrimSpace(string(data))
+		return im.checkPostgresPassword()
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("failed to read Postgres password: %w", err)
+	case !im.generatePassword:
+		im.postgresPassword = DefaultPostgresPassword
+		return nil
+	}
+	if err := im.requireCustomMainImage(); err != nil {
+		return err
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("failed to generate Postgres password: %w", err)
+	}
+	password := hex.EncodeToString(b)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	// O_EXCL: never overwrite the password pgdata was initialized with
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to persist Postgres password: %w", err)
+	}
+	_, err = file.WriteString(password + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to persist Postgres password: %w", err)
+	}
+	im.postgresPassword = password
+	return nil
+}
+
+// checkPostgresPassword fails if the password of the postgres user isn't the
+// default one while the main image can't connect with another
+func (im *IchiranManager) checkPostgresPassword() error {
+	if im.postgresPassword == DefaultPostgresPassword {
+		return nil
+	}
+	return im.requireCustomMainImage()
+}
+
+// requireCustomMainImage fails if the main image is the stock one, which
+// ignores POSTGRES_PASSWORD and only connects with DefaultPostgresPassword
+func (im *IchiranManager) requireCustomMainImage() error {
+	if repositoryOf(im.mainImage) != ghcrRepoMain {
+		return nil
+	}
+	return fmt.Errorf("the main image %s only connects to Postgres with the default password: "+
+		"a custom or generated password requires a main image reading POSTGRES_PASSWORD, set with WithImages", im.mainImage)
+}
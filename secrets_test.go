@@ -0,0 +1,75 @@
+package ichiran
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// customMainImage stands for a main image that connects to Postgres with POSTGRES_PASSWORD
+const customMainImage = "registry.example.com/ichiran-main:custom"
+
+func TestResolvePostgresPassword(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		im := newIchiranManager(WithDataDir(t.TempDir()))
+		require.NoError(t, im.resolvePostgresPassword())
+		assert.Equal(t, DefaultPostgresPassword, im.postgresPassword)
+	})
+
+	t.Run("explicit", func(t *testing.T) {
+		dir := t.TempDir()
+		im := newIchiranManager(WithDataDir(dir), WithImages(customMainImage, ""), WithPostgresPassword("s3cret"), WithGeneratedPostgresPassword())
+		require.NoError(t, im.resolvePostgresPassword())
+		assert.Equal(t, "s3cret", im.postgresPassword)
+		assert.NoFileExists(t, filepath.Join(dir, postgresPasswordFile), "given passwords aren't persisted")
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		dir := t.TempDir()
+		im := newIchiranManager(WithDataDir(dir), WithImages(customMainImage, ""), WithGeneratedPostgresPassword())
+		require.NoError(t, im.resolvePostgresPassword())
+		assert.Len(t, im.postgresPassword, 48)
+		assert.NotEqual(t, DefaultPostgresPassword, im.postgresPassword)
+
+		info, err := os.Stat(filepath.Join(dir, postgresPasswordFile))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		// Later runs reuse the persisted password, even without the option
+		for _, opts := range [][]ManagerOption{
+			{WithDataDir(dir), WithImages(customMainImage, ""), WithGeneratedPostgresPassword()},
+			{WithDataDir(dir), WithImages(customMainImage, "")},
+		} {
+			again := newIchiranManager(opts...)
+			require.NoError(t, again.resolvePostgresPassword())
+			assert.Equal(t, im.postgresPassword, again.postgresPassword)
+		}
+
+		project := im.buildComposeProject(dir)
+		for _, service := range project.Services {
+			assert.Equal(t, im.postgresPassword, *service.Environment["POSTGRES_PASSWORD"])
+		}
+
+		stock := newIchiranManager(WithDataDir(dir))
+		assert.ErrorContains(t, stock.resolvePostgresPassword(), "WithImages", "the persisted password requires a custom main image")
+	})
+
+	t.Run("stock main image", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, opts := range [][]ManagerOption{
+			{WithDataDir(dir), WithPostgresPassword("s3cret")},
+			{WithDataDir(dir), WithGeneratedPostgresPassword()},
+			{WithDataDir(dir), WithRelease("v1.0.0"), WithGeneratedPostgresPassword()},
+		} {
+			im := newIchiranManager(opts...)
+			assert.ErrorContains(t, im.resolvePostgresPassword(), "WithImages")
+		}
+		assert.NoFileExists(t, filepath.Join(dir, postgresPasswordFile), "nothing is generated")
+
+		im := newIchiranManager(WithDataDir(dir), WithPostgresPassword(DefaultPostgresPassword))
+		assert.NoError(t, im.resolvePostgresPassword())
+	})
+}
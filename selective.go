@@ -69,7 +69,7 @@ func (tokens JSONTokens) selectiveTranslit(freqThreshold int, tokenize bool) (*T
 
 	// Process each token
 	for _, token := range tokens {
-		if !token.IsLexical || !ContainsKanjis(token.Surface) {
+		if !token.IsWord() || !ContainsKanjis(token.Surface) {
 			// Preserve non-processable tokens as-is
 			processedToken := ProcessedToken{
 				Original: token.Surface,
@@ -192,7 +192,7 @@ func (tokens JSONTokens) selectiveTranslit(freqThreshold int, tokenize bool) (*T
 	// Join the token results with or without spaces based on tokenize parameter
 	var finalText string
 	if tokenize {
-		finalText = JoinWithSpacingRule(tokenResults)
+		finalText = tokens.joinWithSpacingRule(tokenResults)
 	} else {
 		finalText = strings.Join(tokenResults, "")
 	}
@@ -0,0 +1,263 @@
+package ichiran
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// DefaultSessionMaxRestarts is the number of times a crashed persistent session
+// is restarted while serving a single query before the query is failed.
+var DefaultSessionMaxRestarts = 2
+
+// lispSession is a long-lived ichiran-cli process running inside the main
+// container. The prelude is evaluated once at startup, then forms are sent over
+// the attached stdin and their results read back from stdout, which turns every
+// query into a round-trip instead of a process spawn (SBCL startup, quickload...).
+//
+// Requests are serialized: a session evaluates one form at a time.
+type lispSession struct {
+	im          *IchiranManager
+	maxRestarts int
+
+	mu      sync.Mutex
+	conn    *types.HijackedResponse
+	lines   chan string
+	done    chan struct{}
+	execID  string
+	user    string // user the process runs as
+	queryID string // tags the process, see queryIDEnv
+}
+
+func newLispSession(im *IchiranManager, maxRestarts int) *lispSession {
+	return &lispSession{
+		im:          im,
+		maxRestarts: maxRestarts,
+	}
+}
+
+// eval sends form to the session and returns the JSON it produced. The session
+// is (re)started on demand: if the process died or the stream broke, it is
+// restarted up to maxRestarts times and the form is sent again.
+func (s *lispSession) eval(ctx context.Context, form string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.start(ctx); err != nil {
+				return nil, fmt.Errorf("failed to start ichiran session: %w", err)
+			}
+		}
+
+		output, err := s.roundTrip(ctx, form)
+		if err == nil {
+			return output, nil
+		}
+		if !errors.Is(err, ErrSessionBroken) || ctx.Err() != nil || attempt >= s.maxRestarts {
+			return nil, err
+		}
+		Logger.Warn().Err(err).Msgf("ichiran session crashed, restarting (%d/%d)", attempt+1, s.maxRestarts)
+	}
+}
+
+// start spawns the session process and waits until it has evaluated the prelude.
+func (s *lispSession) start(ctx context.Context) error {
+	client, err := s.im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+
+	containerInfo, err := client.ContainerInspect(ctx, s.im.containerName)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	if !containerInfo.State.Running {
+		return fmt.Errorf("%w: %s", ErrContainerNotRunning, s.im.containerName)
+	}
+
+	queryID := newQueryID()
+	execConfig := container.ExecOptions{
+		User:         containerInfo.Config.User,
+		Cmd:          []string{"bash", "-c", "ichiran-cli -e " + safe(sessionProgram())},
+		Env:          queryEnv(queryID),
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          false,
+		Privileged:   false,
+	}
+
+	exec, err := client.ContainerExecCreate(ctx, s.im.containerName, execConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	// The session outlives the query that started it: don't tie the
+	// attached stream to ctx.
+	resp, err := client.ContainerExecAttach(context.Background(), exec.ID, container.ExecStartOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to attach to exec: %w", err)
+	}
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(&demuxReader{r: resp.Reader})
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			Logger.Debug().Err(err).Msg("ichiran session stream ended")
+		}
+	}()
+
+	s.conn = &resp
+	s.lines = lines
+	s.done = done
+	s.execID = exec.ID
+	s.user = containerInfo.Config.User
+	s.queryID = queryID
+
+	// Wait for the prelude to be evaluated
+	for {
+		select {
+		case <-ctx.Done():
+			s.close()
+			return ctx.Err()
+		case line, ok := <-lines:
+			if !ok {
+				s.close()
+				return fmt.Errorf("%w: process exited during startup", ErrSessionBroken)
+			}
+			if strings.Contains(line, "ichiran-cli: command not found") {
+				s.close()
+				return dnsFailureError([]byte(line))
+			}
+			if strings.TrimSpace(line) == sessionReadyMarker {
+				Logger.Debug().Str("exec", exec.ID).Msg("ichiran session ready")
+				return nil
+			}
+		}
+	}
+}
+
+// roundTrip writes form to the session and reads back the framed result.
+func (s *lispSession) roundTrip(ctx context.Context, form string) ([]byte, error) {
+	if _, err := io.WriteString(s.conn.Conn, form+"\n"); err != nil {
+		s.close()
+		return nil, fmt.Errorf("%w: failed to send form: %v", ErrSessionBroken, err)
+	}
+
+	var payload []string
+	inFrame := false
+	for {
+		select {
+		case <-ctx.Done():
+			// The answer to this form would be read by the next query:
+			// the stream can't be trusted anymore. The process would
+			// only exit once done with the form, kill it.
+			user, queryID := s.user, s.queryID
+			s.close()
+			if queryID != "" {
+				s.im.killQuery(user, queryID)
+			}
+			return nil, ctx.Err()
+		case line, ok := <-s.lines:
+			if !ok {
+				s.close()
+				return nil, fmt.Errorf("%w: process exited", ErrSessionBroken)
+			}
+			switch {
+			case !inFrame:
+				inFrame = strings.TrimSpace(line) == sessionBeginMarker
+			case strings.TrimSpace(line) == sessionEndMarker:
+				return s.framePayload(ctx, payload)
+			default:
+				payload = append(payload, line)
+			}
+		}
+	}
+}
+
+// framePayload turns the lines printed between the frame markers into JSON.
+func (s *lispSession) framePayload(ctx context.Context, payload []string) ([]byte, error) {
+	for _, line := range payload {
+		if msg, isErr := strings.CutPrefix(strings.TrimSpace(line), sessionErrorPrefix); isErr {
+			return nil, &LispError{Message: msg}
+		}
+	}
+	return extractJSON(ctx, []byte(strings.Join(payload, "\n")))
+}
+
+// close terminates the session: closing stdin makes the Lisp loop return.
+func (s *lispSession) close() {
+	if s.conn == nil {
+		return
+	}
+	close(s.done)
+	s.conn.Close()
+	s.conn = nil
+	s.lines = nil
+	s.done = nil
+	s.execID = ""
+	s.user = ""
+	s.queryID = ""
+}
+
+// Close terminates the session if it is running.
+func (s *lispSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+	return nil
+}
+
+// demuxReader strips the 8-byte headers of Docker's multiplexed stream and
+// returns stdout only. Stderr is logged at debug level.
+type demuxReader struct {
+	r         io.Reader
+	remaining uint32
+}
+
+func (d *demuxReader) Read(p []byte) (int, error) {
+	header := make([]byte, 8)
+	for d.remaining == 0 {
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if header[0] == 2 {
+			// stderr frame
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(d.r, payload); err != nil {
+				return 0, err
+			}
+			Logger.Debug().Msgf("ichiran session stderr: %s", payload)
+			continue
+		}
+		d.remaining = size
+	}
+
+	if uint32(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.remaining -= uint32(n)
+	return n, err
+}
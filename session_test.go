@@ -0,0 +1,109 @@
+package ichiran
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// muxFrame builds a frame of Docker's multiplexed stream
+func muxFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemuxReader(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(muxFrame(1, "hello "))
+	stream.Write(muxFrame(2, "some warning"))
+	stream.Write(muxFrame(1, "world\n"))
+
+	out, err := io.ReadAll(&demuxReader{r: &stream})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(out))
+}
+
+// newTestSession returns a session wired to an in-memory connection: what the
+// session writes can be read from the returned conn and its output is fed
+// through the returned channel.
+func newTestSession(t *testing.T) (*lispSession, net.Conn, chan string) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	lines := make(chan string)
+	s := newLispSession(nil, 0)
+	s.conn = &types.HijackedResponse{Conn: client, Reader: bufio.NewReader(client)}
+	s.lines = lines
+	s.done = make(chan struct{})
+	return s, server, lines
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	t.Run("framed result", func(t *testing.T) {
+		s, server, lines := newTestSession(t)
+		go func() {
+			form, _ := bufio.NewReader(server).ReadString('\n')
+			assert.Equal(t, "(+ 1 2)\n", form)
+			lines <- "leftover of a previous query"
+			lines <- sessionBeginMarker
+			lines <- "WARNING: something"
+			lines <- `[["konnichiha"]]`
+			lines <- sessionEndMarker
+		}()
+
+		out, err := s.roundTrip(context.Background(), "(+ 1 2)")
+		require.NoError(t, err)
+		assert.Equal(t, `[["konnichiha"]]`, string(out))
+	})
+
+	t.Run("lisp error", func(t *testing.T) {
+		s, server, lines := newTestSession(t)
+		go func() {
+			bufio.NewReader(server).ReadString('\n')
+			lines <- sessionBeginMarker
+			lines <- sessionErrorPrefix + "The variable FOO is unbound."
+			lines <- sessionEndMarker
+		}()
+
+		_, err := s.roundTrip(context.Background(), "foo")
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrSessionBroken)
+		assert.Contains(t, err.Error(), "FOO is unbound")
+		assert.NotNil(t, s.conn, "a Lisp error must not tear down the session")
+	})
+
+	t.Run("process exited", func(t *testing.T) {
+		s, server, lines := newTestSession(t)
+		go func() {
+			bufio.NewReader(server).ReadString('\n')
+			close(lines)
+		}()
+
+		_, err := s.roundTrip(context.Background(), "(sb-ext:exit)")
+		assert.ErrorIs(t, err, ErrSessionBroken)
+		assert.Nil(t, s.conn, "a broken session must be torn down")
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		s, server, _ := newTestSession(t)
+		go bufio.NewReader(server).ReadString('\n')
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := s.roundTrip(ctx, "(sleep 60)")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Nil(t, s.conn, "a session with a pending answer must be torn down")
+	})
+}
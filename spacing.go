@@ -27,4 +27,19 @@ func JoinWithSpacingRule(tokens []string) string {
 	}
 	
 	return builder.String()
-}
\ No newline at end of file
+}
+
+// joinWithSpacingRule joins parts, each rendered from the token of the same index,
+// using intelligent spacing rules except around whitespace tokens, which are
+// written as is.
+func (tokens JSONTokens) joinWithSpacingRule(parts []string) string {
+	var builder strings.Builder
+	for i, part := range parts {
+		if i > 0 && tokens[i-1].Kind != TokenWhitespace && tokens[i].Kind != TokenWhitespace &&
+			common.DefaultSpacingRule(parts[i-1], part) {
+			builder.WriteRune(' ')
+		}
+		builder.WriteString(part)
+	}
+	return builder.String()
+}
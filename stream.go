@@ -0,0 +1,172 @@
+package ichiran
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// DefaultStreamConcurrency is the number of items AnalyzeStream analyzes at once
+	DefaultStreamConcurrency = 4
+	// MaxStreamItemSize is the maximum size in bytes of an item read by AnalyzeStream
+	MaxStreamItemSize = 1 << 20
+)
+
+// Result is the analysis of an item of the input of AnalyzeStream
+type Result struct {
+	Index  int         // Position of the item in the input, from 0
+	Text   string      // The item
+	Tokens *JSONTokens // Its tokens, nil if Err is set
+	Err    error       // Why the item couldn't be analyzed
+}
+
+// StreamOption configures AnalyzeStream
+type StreamOption func(*streamConfig)
+
+type streamConfig struct {
+	concurrency int
+	split       bufio.SplitFunc
+}
+
+// WithStreamConcurrency sets how many items are analyzed at once. The manager
+// may still limit the queries it runs at once, see WithMaxConcurrency.
+func WithStreamConcurrency(n int) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.concurrency = n
+	}
+}
+
+// WithStreamSplit sets how the input is split into items: bufio.ScanLines, the
+// default, ScanSentences or any other split function.
+func WithStreamSplit(split bufio.SplitFunc) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.split = split
+	}
+}
+
+// AnalyzeStream reads r item by item, one line per item by default, and analyzes
+// the items concurrently with Analyze. Results are sent in the order of the
+// items, blank items being sent without tokens nor error. Failing to analyze an
+// item doesn't stop the stream, only its result has an error; failing to read r
+// does, with a last result holding the read error.
+//
+// The channel is closed once all the items were sent, or as soon as ctx is done:
+// callers must either read all the results or cancel ctx.
+func (im *IchiranManager) AnalyzeStream(ctx context.Context, r io.Reader, opts ...StreamOption) <-chan Result {
+	cfg := streamConfig{
+		concurrency: DefaultStreamConcurrency,
+		split:       bufio.ScanLines,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	concurrency := max(cfg.concurrency, 1)
+
+	results := make(chan Result)
+	// pending holds the future result of each item, in order. Its capacity
+	// bounds how far reading may get ahead of the slowest item.
+	pending := make(chan chan Result, concurrency)
+	slots := make(chan struct{}, concurrency)
+
+	// Read and dispatch the items
+	go func() {
+		defer close(pending)
+		enqueue := func(result chan Result) bool {
+			select {
+			case pending <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, MaxStreamItemSize)
+		scanner.Split(cfg.split)
+		var index int
+		for ; scanner.Scan(); index++ {
+			result := make(chan Result, 1)
+			if !enqueue(result) {
+				return
+			}
+			item := Result{Index: index, Text: scanner.Text()}
+			if strings.TrimSpace(item.Text) == "" {
+				item.Tokens = &JSONTokens{}
+				result <- item
+				continue
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				defer func() { <-slots }()
+				item.Tokens, item.Err = im.Analyze(ctx, item.Text)
+				result <- item
+			}()
+		}
+		if err := scanner.Err(); err != nil {
+			result := make(chan Result, 1)
+			result <- Result{Index: index, Err: fmt.Errorf("failed to read input: %w", err)}
+			enqueue(result)
+		}
+	}()
+
+	// Send the results in order
+	go func() {
+		defer close(results)
+		for result := range pending {
+			select {
+			case res := <-result:
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// AnalyzeStreamWithContext analyzes the items read from r with the default
+// manager, see IchiranManager.AnalyzeStream. If the default manager can't be
+// created, the only result holds the error.
+func AnalyzeStreamWithContext(ctx context.Context, r io.Reader, opts ...StreamOption) <-chan Result {
+	mgr, err := getOrCreateDefaultManager(ctx)
+	if err != nil {
+		results := make(chan Result, 1)
+		results <- Result{Err: err}
+		close(results)
+		return results
+	}
+	return mgr.AnalyzeStream(ctx, r, opts...)
+}
+
+// ScanSentences is a split function for bufio.Scanner, and AnalyzeStream, that
+// returns each sentence of the input along with the closing brackets and
+// whitespace that follow it, splitting where AnalyzeDocument does.
+func ScanSentences(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if sentences := splitSentences(string(data)); len(sentences) > 1 {
+		// The first sentence is complete since another one began, unless what
+		// follows it is only the beginning of a rune that may continue it
+		end := len(sentences[0])
+		if atEOF || utf8.FullRune(data[end:]) {
+			return end, data[:end], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	// Request more data
+	return 0, nil, nil
+}
@@ -0,0 +1,76 @@
+package ichiran
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeStream(t *testing.T) {
+	ctx := context.Background()
+	command, _ := stubCLI(t, konnichihaJSON)
+	manager, err := NewManager(ctx, WithNativeBackend(command))
+	require.NoError(t, err)
+
+	input := "slow こんにちは\n\nfail\nこんにちは\n"
+	var results []Result
+	for result := range manager.AnalyzeStream(ctx, strings.NewReader(input)) {
+		results = append(results, result)
+	}
+
+	require.Len(t, results, 4)
+	for i, result := range results {
+		assert.Equal(t, i, result.Index, "results are in input order")
+	}
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, "slow こんにちは", results[0].Text)
+	assert.Equal(t, "konnichiha", (*results[0].Tokens)[0].Romaji)
+	assert.NoError(t, results[1].Err)
+	assert.Empty(t, *results[1].Tokens)
+	assert.ErrorContains(t, results[2].Err, "boom")
+	assert.Nil(t, results[2].Tokens)
+	assert.NoError(t, results[3].Err)
+
+	t.Run("read error", func(t *testing.T) {
+		r := io.MultiReader(strings.NewReader("こんにちは\n"), iotest.ErrReader(errors.New("disk failure")))
+		var results []Result
+		for result := range manager.AnalyzeStream(ctx, r) {
+			results = append(results, result)
+		}
+		require.Len(t, results, 2)
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, 1, results[1].Index)
+		assert.ErrorContains(t, results[1].Err, "disk failure")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		results := manager.AnalyzeStream(ctx, strings.NewReader(strings.Repeat("hang\n", 10)), WithStreamConcurrency(2))
+		cancel()
+		var n int
+		for range results {
+			n++
+		}
+		assert.Less(t, n, 10)
+	})
+}
+
+func TestScanSentences(t *testing.T) {
+	text := "「行こう。」と言った。本当？！ はい\n最後"
+	scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(text)))
+	scanner.Split(ScanSentences)
+
+	var sentences []string
+	for scanner.Scan() {
+		sentences = append(sentences, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"「行こう。」", "と言った。", "本当？！ ", "はい\n", "最後"}, sentences)
+}
@@ -1,9 +1,12 @@
 package ichiran
 
+import "slices"
+
 // JSONToken represents a single token with all its analysis information
 type JSONToken struct {
 	Surface       string         `json:"text"` // Original text
-	IsLexical     bool           // Whether this is a Japanese token or non-Japanese text
+	Kind          TokenKind      // What the token is made of: Japanese word, punctuation, whitespace...
+	IsLexical     bool           // Whether this is a Japanese token or non-Japanese text. Deprecated: use Kind.
 	Reading       string         `json:"reading"` // Reading with kanji and kana
 	Kana          string         `json:"kana"`    // Kana reading
 	Romaji        string         // Romanized form from ichiran
@@ -16,23 +19,30 @@ type JSONToken struct {
 	Components    []JSONToken    `json:"components"`     // Details of delineable elements of compound expressions
 	Raw           []byte         `json:"-"`              // Raw JSON for future processing
 	KanjiReadings []KanjiReading `json:"-"`              // Parsed kanji-kana mappings
+	Start         int            // Offset in runes of the token in the input
+	End           int            // Offset in runes of the end of the token in the input
+	StartByte     int            // Offset in bytes of the token in the input
+	EndByte       int            // Offset in bytes of the end of the token in the input
+	Unaligned     bool           // Whether ichiran altered Surface so that it wasn't found in the input: the offsets are then a guess
 }
 
 // in case of multiple alternative, jsonTokenCore represents the essential information that are shared,
 // that will spearhead the JSONToken for consistency's sake
 type jsonTokenCore struct {
-	Surface   string `json:"text"` // Original text
-	IsLexical bool   // Whether this is a Japanese token or non-Japanese text
-	Reading   string `json:"reading"` // Reading with kanji and kana
-	Kana      string `json:"kana"`    // Kana reading
-	Romaji    string // Romanized form from ichiran
-	Score     int    `json:"score"` // Analysis score
+	Surface   string    `json:"text"` // Original text
+	Kind      TokenKind // What the token is made of
+	IsLexical bool      // Whether this is a Japanese token or non-Japanese text
+	Reading   string    `json:"reading"` // Reading with kanji and kana
+	Kana      string    `json:"kana"`    // Kana reading
+	Romaji    string    // Romanized form from ichiran
+	Score     int       `json:"score"` // Analysis score
 }
 
 // extractCore returns only the core fields from a JSONToken
 func extractCore(token JSONToken) jsonTokenCore {
 	return jsonTokenCore{
 		Surface:   token.Surface,
+		Kind:      token.Kind,
 		IsLexical: token.IsLexical,
 		Reading:   token.Reading,
 		Kana:      token.Kana,
@@ -44,6 +54,7 @@ func extractCore(token JSONToken) jsonTokenCore {
 // applyCore applies the core fields to a JSONToken
 func (token *JSONToken) applyCore(core jsonTokenCore) {
 	token.Surface = core.Surface
+	token.Kind = core.Kind
 	token.IsLexical = core.IsLexical
 	token.Reading = core.Reading
 	token.Kana = core.Kana
@@ -51,9 +62,90 @@ func (token *JSONToken) applyCore(core jsonTokenCore) {
 	token.Score = core.Score
 }
 
+// clone returns a deep copy of token, sharing no memory with it
+func (token *JSONToken) clone() *JSONToken {
+	c := *token
+	c.Gloss = slices.Clone(token.Gloss)
+	c.Conj = slices.Clone(token.Conj)
+	for i := range c.Conj {
+		c.Conj[i].Prop = slices.Clone(c.Conj[i].Prop)
+		c.Conj[i].Gloss = slices.Clone(c.Conj[i].Gloss)
+	}
+	c.Alternative = cloneTokenValues(token.Alternative)
+	c.Compound = slices.Clone(token.Compound)
+	c.Components = cloneTokenValues(token.Components)
+	c.Raw = slices.Clone(token.Raw)
+	c.KanjiReadings = slices.Clone(token.KanjiReadings)
+	return &c
+}
+
+func cloneTokenValues(tokens []JSONToken) []JSONToken {
+	if tokens == nil {
+		return nil
+	}
+	c := make([]JSONToken, len(tokens))
+	for i := range tokens {
+		c[i] = *tokens[i].clone()
+	}
+	return c
+}
+
+// clone returns a deep copy of tokens, sharing no memory with them
+func (tokens JSONTokens) clone() JSONTokens {
+	if tokens == nil {
+		return nil
+	}
+	c := make(JSONTokens, len(tokens))
+	for i, token := range tokens {
+		c[i] = token.clone()
+	}
+	return c
+}
+
+// TokenKind tells what a token is made of
+type TokenKind int
+
+const (
+	TokenUnknown     TokenKind = iota // Kind not set: IsLexical tells whether the token is a word
+	TokenWord                         // Japanese word analyzed by ichiran
+	TokenPunctuation                  // Punctuation, Japanese or not
+	TokenWhitespace                   // Spaces, tabs, newlines... found between other tokens
+	TokenLatin                        // Non-Japanese letters, e.g. English words
+	TokenNumber                       // Digits, full-width or not
+	TokenSymbol                       // Anything else: emoji, mathematical symbols...
+)
+
+// String returns the name of the kind
+func (k TokenKind) String() string {
+	return map[TokenKind]string{
+		TokenUnknown:     "Unknown",
+		TokenWord:        "Word",
+		TokenPunctuation: "Punctuation",
+		TokenWhitespace:  "Whitespace",
+		TokenLatin:       "Latin",
+		TokenNumber:      "Number",
+		TokenSymbol:      "Symbol",
+	}[k]
+}
+
+// IsWord tells whether the token is a Japanese word analyzed by ichiran. Tokens
+// whose Kind is not set, e.g. built by hand, fall back to IsLexical.
+func (token *JSONToken) IsWord() bool {
+	if token.Kind == TokenUnknown {
+		return token.IsLexical
+	}
+	return token.Kind == TokenWord
+}
+
 // JSONTokens is a slice of token pointers representing a complete analysis result.
 type JSONTokens []*JSONToken
 
+// Segmentation is one of the ways ichiran can split a text into words, see AnalyzeNBest.
+type Segmentation struct {
+	Tokens JSONTokens // Tokens of this segmentation
+	Score  int        // Sum of the scores ichiran gave to the segments, higher is better
+}
+
 // Gloss represents the English glosses and part of speech
 type Gloss struct {
 	Pos   string `json:"pos"`   // Part of speech
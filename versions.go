@@ -0,0 +1,363 @@
+package ichiran
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// DefaultRelease is the tag of the GHCR images used when neither WithRelease
+// nor WithImages is given. As it moves with every release, installs that must
+// produce the same segmentations should pin a release or a digest.
+const DefaultRelease = "latest"
+
+// WithRelease pins the GHCR images to the given release tag instead of DefaultRelease
+func WithRelease(tag string) ManagerOption {
+	return func(im *IchiranManager) {
+		im.mainImage = ghcrRepoMain + ":" + tag
+		im.pgImage = ghcrRepoPg + ":" + tag
+		im.imagesSet = true
+	}
+}
+
+// ImageVersion identifies the image a container runs
+type ImageVersion struct {
+	Reference string // Reference the container was created from, e.g. "ghcr.io/...:latest"
+	ID        string // Local ID of the image
+	Digest    string // Repository digest reference ("repo@sha256:..."), usable with WithImages to pin the image
+}
+
+// VersionInfo tells which images and which version of ichiran serve the
+// queries of a manager, along with a fingerprint of the JMdict data loaded in
+// its database. The JMdict data carries no version of its own: JMdictEntries
+// and JMdictMaxSeq only approximate one, as two databases with the same
+// figures may still differ by entries edited between releases.
+type VersionInfo struct {
+	Main          ImageVersion // Image of the main container, zero for the native backend
+	Pg            ImageVersion // Image of the pg container, zero for the native backend
+	Ichiran       string       // ASDF version of ichiran, empty if it declares none
+	JMdictEntries int          // Number of JMdict entries in the database
+	JMdictMaxSeq  int          // Highest JMdict sequence number, which usually grows with each JMdict release
+}
+
+// versionForm returns the Lisp form reporting the version of ichiran and the
+// fingerprint of the JMdict data it uses. The queries to the database aren't
+// guarded: a missing or broken database makes the form fail.
+func versionForm() string {
+	return `(jsown:to-json
+      (jsown:new-js
+        ("ichiran" (or (ignore-errors (asdf:component-version (asdf:find-system :ichiran))) ""))
+        ("jmdictEntries" (postmodern:query "select count(*) from entry" :single))
+        ("jmdictMaxSeq" (postmodern:query "select max(seq) from entry" :single))))`
+}
+
+// Versions reports the images the containers run, along with the version of
+// ichiran and the fingerprint of the JMdict data loaded in the database, as
+// queried from ichiran itself. The digests can be passed to WithImages to
+// reproduce the install elsewhere.
+func (im *IchiranManager) Versions(ctx context.Context) (*VersionInfo, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, im.QueryTimeout)
+	defer cancel()
+
+	info := &VersionInfo{}
+	if im.usesDocker() {
+		var err error
+		if info.Main, err = im.containerImage(queryCtx, im.containerName); err != nil {
+			return nil, err
+		}
+		if info.Pg, err = im.containerImage(queryCtx, im.pgContainerName()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Bypass the cache: versions must come from the running ichiran
+	output, err := im.evalLispOnce(queryCtx, versionForm())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query versions: %w", err)
+	}
+	var versions struct {
+		Ichiran       string `json:"ichiran"`
+		JMdictEntries int    `json:"jmdictEntries"`
+		JMdictMaxSeq  int    `json:"jmdictMaxSeq"`
+	}
+	if err := json.Unmarshal(output, &versions); err != nil {
+		return nil, fmt.Errorf("failed to decode versions: %w", newParseError(output, err))
+	}
+	info.Ichiran = versions.Ichiran
+	info.JMdictEntries = versions.JMdictEntries
+	info.JMdictMaxSeq = versions.JMdictMaxSeq
+	return info, nil
+}
+
+// containerImage identifies the image of the container name
+func (im *IchiranManager) containerImage(ctx context.Context, name string) (ImageVersion, error) {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return ImageVersion{}, fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	containerInfo, err := client.ContainerInspect(ctx, name)
+	if err != nil {
+		return ImageVersion{}, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	imageInfo, err := client.ImageInspect(ctx, containerInfo.Image)
+	if err != nil {
+		return ImageVersion{}, fmt.Errorf("failed to inspect image of %s: %w", name, err)
+	}
+	return ImageVersion{
+		Reference: containerInfo.Config.Image,
+		ID:        imageInfo.ID,
+		Digest:    digestReference(containerInfo.Config.Image, imageInfo.RepoDigests),
+	}, nil
+}
+
+// imageID returns the local ID of the image reference
+func (im *IchiranManager) imageID(ctx context.Context, reference string) (string, error) {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	imageInfo, err := client.ImageInspect(ctx, reference)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", reference, err)
+	}
+	return imageInfo.ID, nil
+}
+
+// repositoryOf returns the repository of reference, without tag nor digest
+func repositoryOf(reference string) string {
+	repository, _, _ := strings.Cut(reference, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	return repository
+}
+
+// pullImage pulls reference even if an image by that reference is already
+// present, unlike PullImages which skips it
+func (im *IchiranManager) pullImage(ctx context.Context, reference string) error {
+	client, err := im.docker.GetClient()
+	if err != nil {
+		return fmt.Errorf("failed to get Docker client: %w", err)
+	}
+	Logger.Info().Str("image", reference).Msg("pulling image")
+	reader, err := client.ImagePull(ctx, reference, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", reference, err)
+	}
+	defer reader.Close()
+	// Errors are reported in the progress stream
+	if err := jsonmessage.DisplayJSONMessagesStream(reader, io.Discard, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to pull %s: %w", reference, err)
+	}
+	return nil
+}
+
+// digestReference returns the digest reference of repoDigests that belongs to
+// the repository of reference, any of them if none does
+func digestReference(reference string, repoDigests []string) string {
+	repository := repositoryOf(reference)
+	for _, digest := range repoDigests {
+		if strings.HasPrefix(digest, repository+"@") {
+			return digest
+		}
+	}
+	if len(repoDigests) > 0 {
+		return repoDigests[0]
+	}
+	return ""
+}
+
+// UpgradeReadyTimeout bounds the wait for ichiran to answer again once Upgrade
+// recreated the containers. When the pg image changed, this includes rebuilding
+// pgdata from its dump, which takes 20+ minutes: a shorter timeout would roll
+// back upgrades that succeeded.
+var UpgradeReadyTimeout = 40 * time.Minute
+
+// readyPollInterval is the wait between two checks of whether ichiran answers
+var readyPollInterval = 10 * time.Second
+
+// Upgrade pulls the configured images of the manager (those of WithImages or
+// WithRelease, :latest by default) and, if they changed, recreates the
+// containers with them. When the pg image changed, pgdata is rebuilt from the
+// dump of the new image, which takes as long as the first Init; the previous
+// pgdata is kept aside until the upgrade succeeded. The upgrade is checked by
+// querying the versions from ichiran, waiting up to UpgradeReadyTimeout for it
+// to answer: if anything fails, the previous pgdata is restored and the
+// containers go back to the previous images, pinned by digest, until the next
+// Upgrade, which pulls the configured images again. Upgrade waits for the
+// queries in flight and the next ones wait for it, as long as their context
+// allows; the other methods of the manager must not be called meanwhile.
+func (im *IchiranManager) Upgrade(ctx context.Context) error {
+	if !im.usesDocker() {
+		return fmt.Errorf("upgrade is only supported by the Docker backend")
+	}
+	return im.withoutRecovery(ctx, func() error { return im.upgrade(ctx) })
+}
+
+// upgrade does the work of Upgrade
+func (im *IchiranManager) upgrade(ctx context.Context) error {
+	before, err := im.Versions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current versions: %w", err)
+	}
+	if before.Main.Digest == "" || before.Pg.Digest == "" {
+		return fmt.Errorf("running images have no repository digest to roll back to")
+	}
+	for _, reference := range []string{im.pgImage, im.mainImage} {
+		if err := im.pullImage(ctx, reference); err != nil {
+			return err
+		}
+	}
+	mainID, err := im.imageID(ctx, im.mainImage)
+	if err != nil {
+		return err
+	}
+	pgID, err := im.imageID(ctx, im.pgImage)
+	if err != nil {
+		return err
+	}
+	pinned := im.pinnedMainImage != ""
+	if mainID == before.Main.ID && pgID == before.Pg.ID {
+		if pinned {
+			// The configured images caught up with the pinned ones
+			im.pinnedMainImage, im.pinnedPgImage = "", ""
+			if err := im.reconfigureDocker(ctx); err != nil {
+				return err
+			}
+		}
+		Logger.Info().Msg("ichiran images already up to date")
+		return nil
+	}
+
+	im.closeSession()
+	im.resetBackendVersion()
+	if err := im.docker.Stop(); err != nil {
+		return fmt.Errorf("failed to stop containers: %w", err)
+	}
+	var backup string
+	if pgID != before.Pg.ID {
+		// The database is only restored from the dump of the image into an empty pgdata
+		if backup, err = backupPgdata(im.dataDir()); err != nil {
+			err = fmt.Errorf("failed to set pgdata aside: %w", err)
+		}
+	}
+	if err == nil && pinned {
+		// The compose project still runs the images of the last failed upgrade
+		im.pinnedMainImage, im.pinnedPgImage = "", ""
+		err = im.reconfigureDocker(ctx)
+	}
+	if err == nil {
+		err = im.docker.InitRecreate()
+	}
+	var after *VersionInfo
+	if err == nil {
+		after, err = im.waitVersions(ctx, UpgradeReadyTimeout)
+	}
+	if err != nil {
+		if rollbackErr := im.rollbackUpgrade(ctx, before, backup); rollbackErr != nil {
+			return fmt.Errorf("upgrade failed: %w (rollback failed too: %v)", err, rollbackErr)
+		}
+		return fmt.Errorf("upgrade failed, rolled back to the previous images: %w", err)
+	}
+
+	if backup != "" {
+		// pgdata belongs to the postgres user of the container: this may fail
+		if err := os.RemoveAll(backup); err != nil {
+			Logger.Warn().Err(err).Msgf("failed to remove previous pgdata, remove %s manually", backup)
+		}
+	}
+	Logger.Info().Str("ichiran", after.Ichiran).Int("jmdict_max_seq", after.JMdictMaxSeq).
+		Msgf("ichiran upgraded to %s and %s", after.Main.Digest, after.Pg.Digest)
+	return nil
+}
+
+// waitVersions queries the versions until ichiran answers, for up to timeout
+func (im *IchiranManager) waitVersions(ctx context.Context, timeout time.Duration) (*VersionInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		info, err := im.Versions(ctx)
+		if err == nil {
+			return info, nil
+		}
+		Logger.Debug().Err(err).Msg("ichiran not ready yet")
+		select {
+		case <-time.After(readyPollInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("ichiran not ready after %s: %w", timeout, err)
+		}
+	}
+}
+
+// rollbackUpgrade brings back the pgdata and the images in use before a failed
+// upgrade. The images are pinned by digest, as the configured references may
+// point to the new ones by now, but the configured references are kept for
+// the next upgrade.
+func (im *IchiranManager) rollbackUpgrade(ctx context.Context, before *VersionInfo, backup string) error {
+	if err := im.docker.Stop(); err != nil {
+		Logger.Debug().Err(err).Msg("failed to stop containers before rollback")
+	}
+	if backup != "" {
+		if err := restorePgdata(im.dataDir(), backup); err != nil {
+			return err
+		}
+	}
+
+	im.pinnedMainImage, im.pinnedPgImage = before.Main.Digest, before.Pg.Digest
+	if err := im.reconfigureDocker(ctx); err != nil {
+		return err
+	}
+	return im.docker.InitRecreate()
+}
+
+// reconfigureDocker replaces the Docker manager by one running the current
+// images and settings of the manager
+func (im *IchiranManager) reconfigureDocker(ctx context.Context) error {
+	im.logger.Close()
+	im.docker.Close()
+	im.resetBackendVersion()
+	// The Docker manager outlives ctx
+	return im.newDockerManager(context.WithoutCancel(ctx), im.dataDir())
+}
+
+// backupPgdata moves the pgdata directory of dataDir aside, leaving an empty
+// one in its place, and returns where it was moved
+func backupPgdata(dataDir string) (string, error) {
+	pgdataDir := filepath.Join(dataDir, "pgdata")
+	backup := fmt.Sprintf("%s.bak-%d", pgdataDir, time.Now().Unix())
+	if err := os.Rename(pgdataDir, backup); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(pgdataDir, 0755); err != nil {
+		os.Rename(backup, pgdataDir)
+		return "", err
+	}
+	return backup, nil
+}
+
+// restorePgdata puts back the pgdata directory moved aside by backupPgdata.
+// The current pgdata is moved aside too rather than removed, as it belongs to
+// the postgres user of the container.
+func restorePgdata(dataDir, backup string) error {
+	pgdataDir := filepath.Join(dataDir, "pgdata")
+	failed := fmt.Sprintf("%s.failed-%d", pgdataDir, time.Now().Unix())
+	err := os.Rename(pgdataDir, failed)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to set new pgdata aside: %w", err)
+	}
+	if err := os.Rename(backup, pgdataDir); err != nil {
+		return fmt.Errorf("failed to restore pgdata: %w", err)
+	}
+	if err == nil {
+		Logger.Warn().Msgf("pgdata of the failed upgrade left in %s", failed)
+	}
+	return nil
+}
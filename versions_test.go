@@ -0,0 +1,217 @@
+package ichiran
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestReference(t *testing.T) {
+	const digest = "@sha256:0123456789abcdef"
+	tests := []struct {
+		name        string
+		reference   string
+		repoDigests []string
+		want        string
+	}{
+		{
+			name:        "tag",
+			reference:   ghcrImageMain,
+			repoDigests: []string{"mirror.example.com/main" + digest, ghcrRepoMain + digest},
+			want:        ghcrRepoMain + digest,
+		},
+		{
+			name:        "registry with port",
+			reference:   "localhost:5000/ichiran-pg",
+			repoDigests: []string{"localhost:5000/ichiran-pg" + digest},
+			want:        "localhost:5000/ichiran-pg" + digest,
+		},
+		{
+			name:        "digest",
+			reference:   ghcrRepoPg + digest,
+			repoDigests: []string{ghcrRepoPg + digest},
+			want:        ghcrRepoPg + digest,
+		},
+		{
+			name:        "other repository",
+			reference:   "ichiran-main:dev",
+			repoDigests: []string{ghcrRepoMain + digest},
+			want:        ghcrRepoMain + digest,
+		},
+		{
+			name:      "built locally",
+			reference: "ichiran-main:dev",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, digestReference(tt.reference, tt.repoDigests))
+		})
+	}
+}
+
+func TestWithRelease(t *testing.T) {
+	im := newIchiranManager(WithRelease("v1.2.0"))
+	assert.Equal(t, ghcrRepoMain+":v1.2.0", im.mainImage)
+	assert.Equal(t, ghcrRepoPg+":v1.2.0", im.pgImage)
+
+	im = newIchiranManager()
+	assert.Equal(t, ghcrRepoMain+":"+DefaultRelease, im.mainImage)
+}
+
+func TestBackupPgdata(t *testing.T) {
+	dataDir := t.TempDir()
+	pgdataDir := filepath.Join(dataDir, "pgdata")
+	require.NoError(t, os.MkdirAll(pgdataDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pgdataDir, "PG_VERSION"), []byte("16"), 0644))
+
+	backup, err := backupPgdata(dataDir)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(backup, "PG_VERSION"))
+	entries, err := os.ReadDir(pgdataDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "pgdata is left empty for the new image")
+
+	require.NoError(t, os.WriteFile(filepath.Join(pgdataDir, "PG_VERSION"), []byte("17"), 0644))
+	require.NoError(t, restorePgdata(dataDir, backup))
+	data, err := os.ReadFile(filepath.Join(pgdataDir, "PG_VERSION"))
+	require.NoError(t, err)
+	assert.Equal(t, "16", string(data))
+	assert.NoDirExists(t, backup)
+
+	failed, err := filepath.Glob(pgdataDir + ".failed-*")
+	require.NoError(t, err)
+	assert.Len(t, failed, 1, "the pgdata of the failed upgrade is kept aside")
+}
+
+func TestVersions(t *testing.T) {
+	if os.Getenv("ICHIRAN_MANUAL_TEST") != "1" {
+		t.Skip("skipping test that requires Docker; set ICHIRAN_MANUAL_TEST=1 to run")
+	}
+	ctx := context.Background()
+	manager, err := NewManager(ctx)
+	require.NoError(t, err)
+	require.NoError(t, manager.Init(ctx))
+	defer manager.Close()
+
+	info, err := manager.Versions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ghcrImageMain, info.Main.Reference)
+	assert.Contains(t, info.Main.Digest, ghcrRepoMain+"@sha256:")
+	assert.Contains(t, info.Pg.Digest, ghcrRepoPg+"@sha256:")
+	assert.Greater(t, info.JMdictEntries, 100000)
+	assert.Greater(t, info.JMdictMaxSeq, 0)
+
+	// Pinning the digests reproduces the install
+	pinned, err := NewManager(ctx, WithImages(info.Main.Digest, info.Pg.Digest), WithProjectName("ichiran-pinned"))
+	require.NoError(t, err)
+	project := pinned.buildComposeProject(pinned.dataDir())
+	assert.Equal(t, info.Main.Digest, project.Services["main"].Image)
+}
+
+// TestUpgradePullsConfiguredImages fails an upgrade, which pins the previous
+// images by digest, then checks that the next upgrade pulls the configured
+// images again rather than the pinned ones.
+func TestUpgradePullsConfiguredImages(t *testing.T) {
+	savedTimeout, savedInterval := UpgradeReadyTimeout, readyPollInterval
+	UpgradeReadyTimeout, readyPollInterval = 200*time.Millisecond, 10*time.Millisecond
+	defer func() { UpgradeReadyTimeout, readyPollInterval = savedTimeout, savedInterval }()
+
+	ctx := context.Background()
+	im := newIchiranManager(WithDataDir(t.TempDir()))
+	f := newFakeDocker(t, im)
+	mainDigest, pgDigest := ghcrRepoMain+"@sha256:1111", ghcrRepoPg+"@sha256:aaaa"
+	f.images = map[string]string{
+		ghcrImageMain: "sha256:main-1",
+		ghcrImagePg:   "sha256:pg-1",
+		mainDigest:    "sha256:main-1",
+		pgDigest:      "sha256:pg-1",
+	}
+	f.digests = map[string][]string{
+		"sha256:main-1": {mainDigest},
+		"sha256:pg-1":   {pgDigest},
+		"sha256:main-2": {ghcrRepoMain + "@sha256:2222"},
+		"sha256:main-3": {ghcrRepoMain + "@sha256:3333"},
+	}
+	// ichiran of main-2 is broken
+	f.run = func(name string, cmd []string, stdin string) (string, int) {
+		if f.container(name).imageID == "sha256:main-2" {
+			return "", 1
+		}
+		return `{"ichiran":"0.1.0","jmdictEntries":200000,"jmdictMaxSeq":2850000}`, 0
+	}
+	require.NoError(t, im.Init(ctx))
+	pulls := func() (pulled []string) {
+		for _, event := range f.takeEvents() {
+			if reference, ok := strings.CutPrefix(event, "pull "); ok {
+				pulled = append(pulled, reference)
+			}
+		}
+		return pulled
+	}
+
+	f.remote = map[string]string{ghcrImageMain: "sha256:main-2", ghcrImagePg: "sha256:pg-1"}
+	err := im.Upgrade(ctx)
+	assert.ErrorContains(t, err, "rolled back")
+	assert.Equal(t, []string{ghcrImagePg, ghcrImageMain}, pulls())
+	assert.Equal(t, ghcrImageMain, im.mainImage, "the configured image is kept")
+	assert.Equal(t, mainDigest, f.project.Services["main"].Image, "the previous image is pinned")
+	assert.Equal(t, "sha256:main-1", f.container(im.containerName).imageID)
+
+	f.remote[ghcrImageMain] = "sha256:main-3"
+	require.NoError(t, im.Upgrade(ctx))
+	assert.Equal(t, []string{ghcrImagePg, ghcrImageMain}, pulls())
+	assert.Equal(t, ghcrImageMain, f.project.Services["main"].Image, "the pin is lifted")
+	assert.Equal(t, "sha256:main-3", f.container(im.containerName).imageID)
+}
+
+// TestUpgradeWaitsForQueries checks that Upgrade, which may replace the Docker
+// manager, leaves it alone until the query in flight is answered.
+func TestUpgradeWaitsForQueries(t *testing.T) {
+	ctx := context.Background()
+	im := newIchiranManager(WithDataDir(t.TempDir()))
+	f := newFakeDocker(t, im)
+	mainDigest, pgDigest := ghcrRepoMain+"@sha256:1111", ghcrRepoPg+"@sha256:aaaa"
+	f.images = map[string]string{ghcrImageMain: "sha256:main-1", ghcrImagePg: "sha256:pg-1"}
+	f.digests = map[string][]string{"sha256:main-1": {mainDigest}, "sha256:pg-1": {pgDigest}}
+	f.remote = map[string]string{ghcrImageMain: "sha256:main-1", ghcrImagePg: "sha256:pg-1"}
+	querying, answer := make(chan struct{}), make(chan struct{})
+	f.run = func(name string, cmd []string, stdin string) (string, int) {
+		if strings.Contains(stdin, "こんにちは") {
+			close(querying)
+			<-answer
+			return konnichihaJSON, 0
+		}
+		return `{"ichiran":"0.1.0","jmdictEntries":200000,"jmdictMaxSeq":2850000}`, 0
+	}
+	require.NoError(t, im.Init(ctx))
+	f.takeEvents()
+
+	analyzed := make(chan error)
+	go func() {
+		_, err := im.Analyze(ctx, "こんにちは")
+		analyzed <- err
+	}()
+	<-querying
+	upgraded := make(chan error)
+	go func() { upgraded <- im.Upgrade(ctx) }()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-upgraded:
+		t.Fatalf("upgrade didn't wait for the query in flight: %v", err)
+	default:
+	}
+	assert.Equal(t, []string{"exec " + im.containerName + " bash"}, f.takeEvents(), "only the query ran")
+
+	close(answer)
+	require.NoError(t, <-analyzed)
+	require.NoError(t, <-upgraded)
+	assert.Contains(t, f.takeEvents(), "pull "+ghcrImageMain)
+}